@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// auditEntry is a single line in the audit log
+type auditEntry struct {
+	Timestamp       time.Time `json:"timestamp"`
+	Operation       string    `json:"operation"`
+	Image           string    `json:"image,omitempty"`
+	Result          string    `json:"result"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Error           string    `json:"error,omitempty"`
+	DryRun          bool      `json:"dryRun,omitempty"`
+}
+
+// auditLog appends a json line for each operation to a file, as a record of what the heater did separate from its
+// logs; the file is opened for each entry, so it can be rotated by moving it away
+type auditLog struct {
+	path   string
+	dryRun bool
+	mutex  sync.Mutex
+}
+
+func newAuditLog(path string, dryRun bool) *auditLog {
+	return &auditLog{
+		path:   path,
+		dryRun: dryRun,
+	}
+}
+
+func (al *auditLog) write(operation, containerImage string, start time.Time, err error) {
+
+	entry := auditEntry{
+		Timestamp:       start.UTC(),
+		Operation:       operation,
+		Image:           containerImage,
+		Result:          getResultLabel(err),
+		DurationSeconds: time.Since(start).Seconds(),
+		DryRun:          al.dryRun,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed marshaling audit log entry")
+		return
+	}
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	file, err := os.OpenFile(al.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed opening audit log %v", al.path)
+		return
+	}
+	defer file.Close()
+
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		log.Warn().Err(err).Msgf("Failed writing to audit log %v", al.path)
+	}
+}
+
+// auditingDockerRunner writes an audit log entry for each pull, load, removal and prune of the DockerRunner it wraps
+type auditingDockerRunner struct {
+	DockerRunner
+
+	auditLog *auditLog
+}
+
+func newAuditingDockerRunner(dockerRunner DockerRunner, auditLog *auditLog) DockerRunner {
+	return &auditingDockerRunner{
+		DockerRunner: dockerRunner,
+		auditLog:     auditLog,
+	}
+}
+
+func (ar *auditingDockerRunner) runDockerPull(ctx context.Context, container Container, credentials *RegistryCredentials) (downloadedBytes int64, err error) {
+	start := time.Now()
+	downloadedBytes, err = ar.DockerRunner.runDockerPull(ctx, container, credentials)
+	ar.auditLog.write("pull", container.Image, start, err)
+	return
+}
+
+func (ar *auditingDockerRunner) runDockerLoad(ctx context.Context, containerImage, tarballPath string) (err error) {
+	start := time.Now()
+	err = ar.DockerRunner.runDockerLoad(ctx, containerImage, tarballPath)
+	ar.auditLog.write("load", containerImage, start, err)
+	return
+}
+
+func (ar *auditingDockerRunner) runDockerRemoveImage(ctx context.Context, containerImage string) (err error) {
+	start := time.Now()
+	err = ar.DockerRunner.runDockerRemoveImage(ctx, containerImage)
+	ar.auditLog.write("remove", containerImage, start, err)
+	return
+}
+
+func (ar *auditingDockerRunner) runDockerSystemPrune(ctx context.Context, keepImages []string) (err error) {
+	start := time.Now()
+	err = ar.DockerRunner.runDockerSystemPrune(ctx, keepImages)
+	ar.auditLog.write("system-prune", "", start, err)
+	return
+}
+
+func (ar *auditingDockerRunner) runDockerImagePrune(ctx context.Context) (err error) {
+	start := time.Now()
+	err = ar.DockerRunner.runDockerImagePrune(ctx)
+	ar.auditLog.write("image-prune", "", start, err)
+	return
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	completionWebhookTimeout = 10 * time.Second
+)
+
+// completionWebhook posts the outcome of each heating cycle to a url, for tracking cache freshness across heaters
+type completionWebhook struct {
+	url    string
+	client *http.Client
+}
+
+type completionPayload struct {
+	Hostname        string    `json:"hostname"`
+	Timestamp       time.Time `json:"timestamp"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Images          int       `json:"images"`
+	Succeeded       int       `json:"succeeded"`
+	Failed          int       `json:"failed"`
+	FailedImages    []string  `json:"failedImages,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+func newCompletionWebhook(url string) *completionWebhook {
+	return &completionWebhook{
+		url: url,
+		client: &http.Client{
+			Timeout: completionWebhookTimeout,
+		},
+	}
+}
+
+// notify posts the cycle result; failures are only logged, since they shouldn't affect heating
+func (cw *completionWebhook) notify(result cycleResult, duration time.Duration, cycleErr error) {
+
+	if cw.url == "" {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+
+	payload := completionPayload{
+		Hostname:        hostname,
+		Timestamp:       time.Now().UTC(),
+		DurationSeconds: duration.Seconds(),
+		Images:          result.images,
+		Succeeded:       len(result.pulledImages),
+		Failed:          len(result.failedPulls),
+	}
+	for _, f := range result.failedPulls {
+		payload.FailedImages = append(payload.FailedImages, f.image)
+	}
+	if cycleErr != nil {
+		payload.Error = cycleErr.Error()
+	}
+
+	if err := cw.post(payload); err != nil {
+		log.Warn().Err(err).Msg("Failed notifying completion webhook")
+	}
+}
+
+func (cw *completionWebhook) post(payload completionPayload) error {
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := cw.client.Post(cw.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Completion webhook responded with status code %v", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// renderContainerList renders the container list as a go template with the values in the yaml values file, so image
+// tags can be parameterized per environment like {{ .appVersion }}; without a values file the list is used as is
+func renderContainerList(source string, data []byte, valuesFile string) ([]byte, error) {
+
+	if valuesFile == "" {
+		return data, nil
+	}
+
+	valuesData, err := ioutil.ReadFile(valuesFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading values file %v: %v", valuesFile, err)
+	}
+
+	var values map[string]interface{}
+	if err = yaml.Unmarshal(valuesData, &values); err != nil {
+		return nil, fmt.Errorf("Failed unmarshaling values file %v: %v", valuesFile, err)
+	}
+
+	// fail on values missing from the values file instead of rendering <no value> into the image
+	tmpl, err := template.New(source).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing template %v: %v", source, err)
+	}
+
+	var rendered bytes.Buffer
+	if err = tmpl.Execute(&rendered, values); err != nil {
+		return nil, fmt.Errorf("Failed rendering template %v with values file %v: %v", source, valuesFile, err)
+	}
+
+	return rendered.Bytes(), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// watchContainerList signals on the returned channel whenever the container list file, or any of the files in the
+// directory or matching the glob pattern, changes; it watches the directory instead of the file itself, because
+// kubernetes updates a mounted configmap by swapping the ..data symlink
+func watchContainerList(containerListFilePath string) (<-chan struct{}, error) {
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	directory := filepath.Dir(containerListFilePath)
+	fileNamePattern := filepath.Base(containerListFilePath)
+	if info, err := os.Stat(containerListFilePath); err == nil && info.IsDir() {
+		directory = containerListFilePath
+		fileNamePattern = "*.yaml"
+	}
+
+	if err = watcher.Add(directory); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	// buffer a single change, so multiple events in quick succession trigger a single reload
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				name := filepath.Base(event.Name)
+				if matches, _ := filepath.Match(fileNamePattern, name); !matches && name != "..data" {
+					continue
+				}
+				if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename|fsnotify.Remove) == 0 {
+					continue
+				}
+
+				log.Info().Msgf("Detected change to %v (%v)", containerListFilePath, event)
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Warn().Err(err).Msgf("Failed watching %v for changes", containerListFilePath)
+			}
+		}
+	}()
+
+	return changes, nil
+}
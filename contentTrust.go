@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// messages of the docker cli when an image fails content trust verification
+var untrustedImageErrors = []string{
+	"trust data",
+	"trusted root",
+	"notary",
+}
+
+// untrustedImageError is a pull that failed content trust verification, which is reported separately from other
+// failures since pulling again won't help
+type untrustedImageError struct {
+	image string
+	err   error
+}
+
+func (e untrustedImageError) Error() string {
+	return fmt.Sprintf("Image %v failed content trust verification: %v", e.image, e.err)
+}
+
+func isUntrustedImageError(err error) bool {
+	message := strings.ToLower(err.Error())
+	for _, untrustedMessage := range untrustedImageErrors {
+		if strings.Contains(message, untrustedMessage) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isExperimentalDaemon returns whether the started docker daemon runs in experimental mode, which the docker 18.09 cli
+// needs to pull with content trust for a platform; the json is only merged into the daemon.json if one is rendered
+func isExperimentalDaemon(daemonArgs []string, daemonConfigFile, daemonConfigJSON string) bool {
+	for _, arg := range daemonArgs {
+		if arg == "--experimental" || arg == "--experimental=true" {
+			return true
+		}
+	}
+
+	if daemonConfigFile == "" {
+		return false
+	}
+
+	var daemonConfig map[string]interface{}
+	if err := json.Unmarshal([]byte(daemonConfigJSON), &daemonConfig); err == nil && daemonConfig["experimental"] == true {
+		return true
+	}
+
+	return false
+}
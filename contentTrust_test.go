@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIsExperimentalDaemon(t *testing.T) {
+
+	for _, c := range []struct {
+		daemonArgs       []string
+		daemonConfigFile string
+		daemonConfigJSON string
+		expected         bool
+	}{
+		{nil, "", "", false},
+		{[]string{"--experimental"}, "", "", true},
+		{[]string{"--log-level=warn", "--experimental=true"}, "", "", true},
+		{[]string{"--experimental=false"}, "", "", false},
+		{nil, "/etc/docker/daemon.json", `{"experimental": true}`, true},
+		{nil, "/etc/docker/daemon.json", `{"experimental": false, "debug": true}`, false},
+		// the json is ignored without a daemon.json to merge it into
+		{nil, "", `{"experimental": true}`, false},
+	} {
+		if experimental := isExperimentalDaemon(c.daemonArgs, c.daemonConfigFile, c.daemonConfigJSON); experimental != c.expected {
+			t.Errorf("Expected %v for daemon args %v and config %v, got %v", c.expected, c.daemonArgs, c.daemonConfigJSON, experimental)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// cloud registry tokens are valid for an hour or more, so a few minutes keeps them fresh without running the helper
+	// for every image
+	credentialHelperCacheDuration = 5 * time.Minute
+	credentialHelperTimeout       = 30 * time.Second
+)
+
+// the name of a credential helper is the suffix of its docker-credential-<name> binary
+var credentialHelperRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// credentialHelperOutput is what a docker credential helper writes to stdout for the get command
+type credentialHelperOutput struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+type cachedHelperCredentials struct {
+	username  string
+	password  string
+	expiresAt time.Time
+}
+
+// credentialHelpers gets short-lived credentials for cloud registries like ecr, gcr and acr from docker credential
+// helpers, caching them briefly so the helper doesn't run for every image
+type credentialHelpers struct {
+	cache map[string]cachedHelperCredentials
+	mutex sync.Mutex
+}
+
+func newCredentialHelpers() *credentialHelpers {
+	return &credentialHelpers{
+		cache: map[string]cachedHelperCredentials{},
+	}
+}
+
+// resolve returns a copy of the credentials with the username and password from their credential helper, or the
+// credentials themselves if they don't use a helper; if the helper fails the images are pulled anonymously
+func (ch *credentialHelpers) resolve(credentials *RegistryCredentials) *RegistryCredentials {
+	if credentials == nil || credentials.CredentialHelper == "" {
+		return credentials
+	}
+
+	registry := normalizeRegistry(credentials.Registry)
+
+	username, password, err := ch.get(credentials.CredentialHelper, registry)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed getting credentials for registry %v from credential helper %v", registry, credentials.CredentialHelper)
+		return nil
+	}
+
+	resolved := *credentials
+	resolved.Username = username
+	resolved.Password = password
+
+	return &resolved
+}
+
+func (ch *credentialHelpers) get(helper, registry string) (username, password string, err error) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	key := helper + " " + registry
+	if cached, ok := ch.cache[key]; ok && time.Now().Before(cached.expiresAt) {
+		return cached.username, cached.password, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), credentialHelperTimeout)
+	defer cancel()
+
+	// the published image doesn't include any credential helpers
+	name := "docker-credential-" + helper
+	if _, err := exec.LookPath(name); err != nil {
+		return "", "", fmt.Errorf("Credential helper %v isn't installed, it has to be added to the image: %v", name, err)
+	}
+
+	// docker-credential-ecr-login get, with the server address on stdin
+	cmd := exec.CommandContext(ctx, name, "get")
+	cmd.Stdin = strings.NewReader(getServerAddress(registry))
+	stdout, err := runCommand(cmd)
+	if err != nil {
+		return "", "", err
+	}
+
+	var output credentialHelperOutput
+	if err = json.Unmarshal(stdout, &output); err != nil {
+		return "", "", fmt.Errorf("Failed unmarshaling output of credential helper %v: %v", helper, err)
+	}
+	if output.Secret == "" {
+		return "", "", fmt.Errorf("Credential helper %v returned no secret for registry %v", helper, registry)
+	}
+
+	log.Debug().Msgf("Got credentials for registry %v from credential helper %v", registry, helper)
+
+	ch.cache[key] = cachedHelperCredentials{
+		username:  output.Username,
+		password:  output.Secret,
+		expiresAt: time.Now().Add(credentialHelperCacheDuration),
+	}
+
+	return output.Username, output.Secret, nil
+}
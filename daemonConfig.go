@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// getDaemonConfig returns the daemon configuration in the form of daemon.json, the same settings as
+// getDaemonConfigArgs with the user supplied json merged on top of it
+func (dr *dockerRunnerImpl) getDaemonConfig() (map[string]interface{}, error) {
+
+	mtu, err := strconv.Atoi(dr.mtu)
+	if err != nil {
+		return nil, fmt.Errorf("Mtu %v is not a number: %v", dr.mtu, err)
+	}
+
+	config := map[string]interface{}{
+		"hosts":                    dr.dockerHosts,
+		"mtu":                      mtu,
+		"storage-driver":           dr.storageDriver,
+		"max-concurrent-downloads": dr.maxConcurrentDownloads,
+		"debug":                    dr.debug,
+	}
+	if dr.dataRoot != "" {
+		config["data-root"] = dr.dataRoot
+	}
+	if registryMirrors := dr.getDaemonRegistryMirrors(); len(registryMirrors) > 0 {
+		config["registry-mirrors"] = registryMirrors
+	}
+	if len(dr.insecureRegistries) > 0 {
+		config["insecure-registries"] = dr.insecureRegistries
+	}
+
+	// top level keys in the user supplied json replace the generated ones
+	if dr.daemonConfigJSON != "" {
+		var userConfig map[string]interface{}
+		if err := json.Unmarshal([]byte(dr.daemonConfigJSON), &userConfig); err != nil {
+			return nil, fmt.Errorf("Failed unmarshaling daemon config json: %v", err)
+		}
+		for key, value := range userConfig {
+			config[key] = value
+		}
+	}
+
+	return config, nil
+}
+
+// writeDaemonConfig renders the daemon configuration to the daemon config file
+func (dr *dockerRunnerImpl) writeDaemonConfig() error {
+
+	config, err := dr.getDaemonConfig()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed marshaling daemon config: %v", err)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dr.daemonConfigFile), 0755); err != nil {
+		return fmt.Errorf("Failed creating directory for daemon config %v: %v", dr.daemonConfigFile, err)
+	}
+
+	if err = ioutil.WriteFile(dr.daemonConfigFile, data, 0644); err != nil {
+		return fmt.Errorf("Failed writing daemon config %v: %v", dr.daemonConfigFile, err)
+	}
+
+	log.Debug().Msgf("Wrote daemon config %v:\n%v", dr.daemonConfigFile, string(data))
+
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"syscall"
+)
+
+// getDiskUsagePercent returns the percentage of used space on the filesystem holding path
+func getDiskUsagePercent(path string) (float64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	// use the blocks available to unprivileged users, like df does
+	used := stat.Blocks - stat.Bfree
+	total := used + stat.Bavail
+	if total == 0 {
+		return 0, nil
+	}
+
+	return float64(used) / float64(total) * 100, nil
+}
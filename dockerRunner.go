@@ -1,109 +1,864 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"math"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	pullRetryBackoffSeconds = 5
+
+	noSpaceLeftError = "no space left on device"
+
+	// the interval between checking whether the daemon is ready doubles from the minimum up to the maximum
+	minDaemonPollInterval = 100 * time.Millisecond
+	maxDaemonPollInterval = 5 * time.Second
+
+	// the unauthenticated tcp address the started docker daemon listens on with --enable-tcp-host
+	tcpDockerHost = "tcp://0.0.0.0:2375"
+
+	// where dockerd stores its images unless --docker-data-root is set
+	defaultDockerDataRoot = "/var/lib/docker"
+
+	// the files a docker daemon that didn't shut down cleanly leaves behind, which keep a new daemon from starting
+	dockerPidFile      = "/var/run/docker.pid"
+	containerdPidFile  = "/var/run/docker/containerd/containerd.pid"
+	containerdSocket   = "/var/run/docker/containerd/containerd.sock"
+	daemonStartBackoff = 5 * time.Second
+
+	// containers with this label are excluded from pruning, and so are the images they use
+	keepLabel = "estafette.io/docker-cache-heater.keep"
+)
+
+var supportedStorageDrivers = []string{
+	"overlay2",
+	"overlay",
+	"fuse-overlayfs",
+	"aufs",
+	"btrfs",
+	"zfs",
+	"devicemapper",
+	"vfs",
+}
+
+var nonRetryablePullErrors = []string{
+	"manifest unknown",
+	"not found",
+	"repository does not exist",
+	"invalid reference format",
+	"unauthorized",
+	"denied",
+	// pulling again only helps once space has been freed, which the heater does with an emergency prune
+	noSpaceLeftError,
+}
+
 // DockerRunner pulls and runs docker containers
 type DockerRunner interface {
 	startDockerDaemon() error
-	waitForDockerDaemon()
+	waitForDockerDaemon(ctx context.Context) error
+	superviseDockerDaemon(ctx context.Context)
+	isDockerDaemonReady(ctx context.Context) bool
+
+	runDockerLogin(ctx context.Context, credentials RegistryCredentials) error
+	runDockerPull(ctx context.Context, container Container, credentials *RegistryCredentials) (downloadedBytes int64, err error)
+	runDockerLoad(ctx context.Context, containerImage, tarballPath string) error
+	runDockerRemoveImage(ctx context.Context, containerImage string) error
+	getImageDigests(ctx context.Context, containerImage string) ([]string, error)
+	getImageSize(ctx context.Context, containerImage string) (int64, error)
+	listImages(ctx context.Context) ([]localImage, error)
+	runDockerSystemPrune(ctx context.Context, keepImages []string) error
+	runDockerImagePrune(ctx context.Context) error
+}
+
+// localImage is an image in the local store, with the tags and repo digests referring to it
+type localImage struct {
+	ID          string
+	RepoTags    []string
+	RepoDigests []string
+}
 
-	runDockerPull(containerImage string) error
-	runDockerRemoveImage(containerImage string) error
-	runDockerSystemPrune() error
+// dockerRunnerConfig holds the settings for the docker daemon and the pulls
+type dockerRunnerConfig struct {
+	// when false the heater uses an external docker daemon at DOCKER_HOST instead of starting its own
+	manageDaemon bool
+	// the addresses the started docker daemon listens on, the first one is used by the heater itself
+	dockerHosts []string
+	debug       bool
+	mtu         string
+	// registry mirrors for docker hub images, tried in order
+	registryMirrors []string
+	// credentials for the registry mirrors that require authentication by mirror host; the heater pulls from those
+	// mirrors itself instead of the daemon
+	registryMirrorCredentials map[string]RegistryCredentials
+	storageDriver             string
+	// the directory the started docker daemon stores its images in, dockerd's default if empty
+	dataRoot               string
+	maxConcurrentDownloads int
+	insecureRegistries     []string
+	daemonArgs             []string
+	// render the daemon configuration to this daemon.json file instead of passing it as arguments, merged with the
+	// user supplied json
+	daemonConfigFile  string
+	daemonConfigJSON  string
+	daemonMaxRestarts int
+	// the number of lines of the docker daemon's stderr to report when it fails
+	daemonStderrLines int
+	// how long to wait for the docker daemon to be ready before giving up
+	daemonStartupTimeout time.Duration
+	pullMaxRetries       int
+	// retry pulls the registry rate limited, when the heater doesn't skip the registry for a cooldown instead
+	retryRateLimitedPulls bool
+	pullTimeoutSeconds    int
+	pullProgress          bool
+	// only log a single line for each pulled image
+	quietPulls bool
+	// the priority of the started docker daemon, which does the downloading and extracting for the pulls
+	pullPriority pullPriority
+	// pull with the docker cli with content trust enabled, so only signed images are pulled
+	contentTrust bool
+	// prune unused volumes as well, like docker system prune --volumes
+	pruneVolumes bool
+	// prune the build cache, which docker system prune does by default
+	pruneBuildCache bool
+	// log the docker commands equivalent to the pulls and prunes instead of running them
+	dryRun bool
 }
 
 type dockerRunnerImpl struct {
-	debug          bool
-	mtu            string
-	registryMirror string
+	dockerRunnerConfig
+
+	dockerClient dockerAPIClient
+	jitter       *jitter
+
+	// creates the dockerd and docker cli processes, exec.CommandContext unless replaced to avoid spawning real processes
+	execCommand func(ctx context.Context, name string, arg ...string) *exec.Cmd
+
+	// closed once the dockerd process exits, with the result in dockerDaemonExitErr
+	dockerDaemonCommand *exec.Cmd
+	dockerDaemonExited  chan struct{}
+	dockerDaemonExitErr error
+	dockerDaemonStderr  *lastLinesWriter
+
+	registryLogins *registryLogins
 }
 
 // NewDockerRunner returns a new DockerRunner
-func NewDockerRunner(debug bool, mtu, registryMirror string) DockerRunner {
+func NewDockerRunner(jitter *jitter, config dockerRunnerConfig) (DockerRunner, error) {
+
+	if !isSupportedStorageDriver(config.storageDriver) {
+		return nil, fmt.Errorf("Storage driver %v is not supported, use one of %v", config.storageDriver, strings.Join(supportedStorageDrivers, ", "))
+	}
+
+	if config.manageDaemon && len(config.dockerHosts) == 0 {
+		return nil, fmt.Errorf("At least one docker host is needed for the docker daemon to listen on")
+	}
+
+	for _, registryMirror := range config.registryMirrors {
+		if err := validateRegistryMirror(registryMirror); err != nil {
+			return nil, err
+		}
+	}
+	for mirror := range config.registryMirrorCredentials {
+		if !isRegistryMirror(config.registryMirrors, mirror) {
+			return nil, fmt.Errorf("Registry mirror credentials are set for %v, which isn't one of the registry mirrors", mirror)
+		}
+	}
+
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if config.manageDaemon {
+		// talk to the daemon started by the heater on the first host it listens on
+		opts = append(opts, client.WithHost(config.dockerHosts[0]))
+	}
+
+	// the client only connects once used, so it can be created before the daemon is started
+	dockerClient, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDockerRunnerImpl(jitter, config, dockerClient, exec.CommandContext), nil
+}
+
+// validateRegistryMirror checks the mirror is an http or https url, since dockerd refuses to start otherwise
+func validateRegistryMirror(registryMirror string) error {
+	mirrorURL, err := url.Parse(registryMirror)
+	if err != nil {
+		return fmt.Errorf("Registry mirror %v is not a valid url: %v", registryMirror, err)
+	}
+	if (mirrorURL.Scheme != "http" && mirrorURL.Scheme != "https") || mirrorURL.Host == "" {
+		return fmt.Errorf("Registry mirror %v is not an http or https url like https://mirror.example.com", registryMirror)
+	}
+	return nil
+}
+
+func isRegistryMirror(registryMirrors []string, mirror string) bool {
+	for _, registryMirror := range registryMirrors {
+		if normalizeRegistry(registryMirror) == mirror {
+			return true
+		}
+	}
+	return false
+}
+
+// newDockerRunnerImpl returns a docker runner using the given docker client and process creation
+func newDockerRunnerImpl(jitter *jitter, config dockerRunnerConfig, dockerClient dockerAPIClient, execCommand func(ctx context.Context, name string, arg ...string) *exec.Cmd) *dockerRunnerImpl {
 	return &dockerRunnerImpl{
-		debug:          debug,
-		mtu:            mtu,
-		registryMirror: registryMirror,
+		dockerRunnerConfig: config,
+
+		dockerClient: dockerClient,
+		jitter:       jitter,
+		execCommand:  execCommand,
+
+		registryLogins: newRegistryLogins(),
+	}
+}
+
+func isSupportedStorageDriver(storageDriver string) bool {
+	for _, supportedStorageDriver := range supportedStorageDrivers {
+		if storageDriver == supportedStorageDriver {
+			return true
+		}
 	}
+	return false
 }
 
 func (dr *dockerRunnerImpl) startDockerDaemon() error {
 
-	// dockerd --host=unix:///var/run/docker.sock --host=tcp://0.0.0.0:2375 --storage-driver=$STORAGE_DRIVER &
+	if !dr.manageDaemon {
+		log.Info().Msgf("Using external docker daemon at %v", dr.getDockerHost())
+		return nil
+	}
+
 	log.Debug().Msg("Starting docker daemon...")
-	args := []string{"--host=unix:///var/run/docker.sock", fmt.Sprintf("--mtu=%v", dr.mtu), "--host=tcp://0.0.0.0:2375", "--storage-driver=overlay2", "--max-concurrent-downloads=10"}
 
-	if dr.debug {
-		args = append(args, "--debug")
+	// stop a previous attempt that didn't become ready and clean up after it or a daemon that didn't shut down cleanly
+	dr.killDockerDaemon()
+	dr.removeStaleDaemonFiles()
+
+	if len(dr.registryMirrors) > 0 {
+		log.Info().Strs("registryMirrors", dr.registryMirrors).Msgf("Using registry mirrors %v for docker hub images", strings.Join(dr.registryMirrors, ", "))
+	}
+	if len(dr.registryMirrorCredentials) > 0 {
+		log.Info().Msgf("Pulling docker hub images from the registry mirrors with credentials before the daemon's mirrors %v", strings.Join(dr.getDaemonRegistryMirrors(), ", "))
 	}
 
-	// if a registry mirror is set in config configured docker daemon to use it
-	if dr.registryMirror != "" {
-		args = append(args, fmt.Sprintf("--registry-mirror=%v", dr.registryMirror))
+	if dr.dataRoot != "" {
+		if err := os.MkdirAll(dr.dataRoot, 0711); err != nil {
+			return fmt.Errorf("Failed creating docker data root %v: %v", dr.dataRoot, err)
+		}
 	}
 
+	var args []string
+	if dr.daemonConfigFile != "" {
+		// dockerd --config-file=/etc/docker/daemon.json &
+		err := dr.writeDaemonConfig()
+		if err != nil {
+			return err
+		}
+		args = []string{fmt.Sprintf("--config-file=%v", dr.daemonConfigFile)}
+	} else {
+		args = dr.getDaemonConfigArgs()
+	}
+
+	// append the passthrough arguments last, so they can extend or override the ones above
+	args = append(args, dr.daemonArgs...)
+
 	log.Debug().Msgf("dockerd %v", strings.Join(args, " "))
 
-	dockerDaemonCommand := exec.Command("dockerd", args...)
-	dockerDaemonCommand.Stdout = log.Logger
-	dockerDaemonCommand.Stderr = log.Logger
+	// keep the last lines of stderr to report them if the daemon fails
+	dr.dockerDaemonStderr = newLastLinesWriter(dr.daemonStderrLines)
+
+	// tag the daemon's output, so it can be told apart from the heater's own logs
+	dockerDaemonLogger := log.With().Str("source", "dockerd").Logger()
+
+	name, args := dr.pullPriority.wrap("dockerd", args...)
+	// the daemon outlives the heating cycles, it's stopped by killDockerDaemon
+	dockerDaemonCommand := dr.execCommand(context.Background(), name, args...)
+	dockerDaemonCommand.Stdout = dockerDaemonLogger
+	dockerDaemonCommand.Stderr = io.MultiWriter(dockerDaemonLogger, dr.dockerDaemonStderr)
 	err := dockerDaemonCommand.Start()
 	if err != nil {
 		return err
 	}
 
+	dr.dockerDaemonCommand = dockerDaemonCommand
+	dockerDaemonExited := make(chan struct{})
+	dr.dockerDaemonExited = dockerDaemonExited
+	go func() {
+		dr.dockerDaemonExitErr = dockerDaemonCommand.Wait()
+		close(dockerDaemonExited)
+	}()
+
 	return nil
 }
 
-func (dr *dockerRunnerImpl) waitForDockerDaemon() {
+func (dr *dockerRunnerImpl) waitForDockerDaemon(ctx context.Context) error {
 
-	// wait until /var/run/docker.sock exists
+	// wait until the docker daemon responds to requests, since the socket exists before the daemon is ready to use
 	log.Debug().Msg("Waiting for docker daemon to be ready for use...")
-	for {
-		if _, err := os.Stat("/var/run/docker.sock"); os.IsNotExist(err) {
-			// does not exist
-			time.Sleep(1000 * time.Millisecond)
-		} else {
-			// file exists, break out of for loop
-			break
+
+	timeout := time.After(dr.daemonStartupTimeout)
+	pollInterval := minDaemonPollInterval
+	for !dr.isDockerDaemonReady(ctx) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-dr.dockerDaemonExited:
+			return fmt.Errorf("Docker daemon failed to start, it exited with %v; its last lines of stderr are:\n%v", dr.dockerDaemonExitErr, dr.dockerDaemonStderr)
+		case <-timeout:
+			if !dr.manageDaemon {
+				return fmt.Errorf("External docker daemon at %v wasn't ready within %v", dr.getDockerHost(), dr.daemonStartupTimeout)
+			}
+			return fmt.Errorf("Docker daemon failed to start, it wasn't ready within %v; its last lines of stderr are:\n%v", dr.daemonStartupTimeout, dr.dockerDaemonStderr)
+		case <-time.After(pollInterval):
 		}
+		pollInterval = getNextDaemonPollInterval(pollInterval)
 	}
+
 	log.Debug().Msg("Docker daemon is ready for use")
+
+	return nil
+}
+
+// startDockerDaemonWithRetries starts the docker daemon and waits for it to be ready, starting it again with backoff
+// when it fails, for example because of files left behind by a previous daemon
+func startDockerDaemonWithRetries(ctx context.Context, dockerRunner DockerRunner, retries int) (err error) {
+	backoff := daemonStartBackoff
+	for attempt := 1; ; attempt++ {
+		err = dockerRunner.startDockerDaemon()
+		if err == nil {
+			err = dockerRunner.waitForDockerDaemon(ctx)
+		}
+		if err == nil || ctx.Err() != nil || attempt > retries {
+			return
+		}
+
+		log.Warn().Err(err).Msgf("Failed starting docker daemon (attempt %v of %v), trying again in %v...", attempt, retries+1, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// getNextDaemonPollInterval backs off exponentially, so a slowly starting daemon isn't polled in a tight loop
+func getNextDaemonPollInterval(pollInterval time.Duration) time.Duration {
+	pollInterval *= 2
+	if pollInterval > maxDaemonPollInterval {
+		return maxDaemonPollInterval
+	}
+	return pollInterval
+}
+
+// superviseDockerDaemon restarts the docker daemon whenever it exits, and exits the heater when the daemon has been
+// restarted too often, so kubernetes can reschedule it; it stops supervising once the context is cancelled on shutdown
+func (dr *dockerRunnerImpl) superviseDockerDaemon(ctx context.Context) {
+
+	// an external daemon is supervised by whatever runs it
+	if !dr.manageDaemon {
+		return
+	}
+
+	restarts := 0
+	for {
+		select {
+		case <-dr.dockerDaemonExited:
+		case <-ctx.Done():
+			return
+		}
+		log.Error().Err(dr.dockerDaemonExitErr).Msgf("Docker daemon exited unexpectedly; its last lines of stderr are:\n%v", dr.dockerDaemonStderr)
+
+		for {
+			if restarts >= dr.daemonMaxRestarts {
+				log.Fatal().Msgf("Docker daemon exited after being restarted %v times, giving up", restarts)
+			}
+			restarts++
+
+			log.Warn().Msgf("Restarting docker daemon (restart %v of %v)...", restarts, dr.daemonMaxRestarts)
+			err := dr.startDockerDaemon()
+			if err == nil {
+				err = dr.waitForDockerDaemon(ctx)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				log.Info().Msg("Restarted docker daemon")
+				break
+			}
+
+			log.Error().Err(err).Msg("Failed restarting docker daemon")
+			dr.killDockerDaemon()
+		}
+	}
+}
+
+// getDaemonConfigArgs returns the daemon configuration as dockerd arguments
+func (dr *dockerRunnerImpl) getDaemonConfigArgs() []string {
+
+	// dockerd --host=unix:///var/run/docker.sock --storage-driver=$STORAGE_DRIVER &
+	args := []string{}
+	for _, dockerHost := range dr.dockerHosts {
+		args = append(args, fmt.Sprintf("--host=%v", dockerHost))
+	}
+	args = append(args, fmt.Sprintf("--mtu=%v", dr.mtu), fmt.Sprintf("--storage-driver=%v", dr.storageDriver), fmt.Sprintf("--max-concurrent-downloads=%v", dr.maxConcurrentDownloads))
+
+	if dr.dataRoot != "" {
+		args = append(args, fmt.Sprintf("--data-root=%v", dr.dataRoot))
+	}
+
+	if dr.debug {
+		args = append(args, "--debug")
+	}
+
+	// if a registry mirror is set in config configured docker daemon to use it
+	for _, registryMirror := range dr.getDaemonRegistryMirrors() {
+		args = append(args, fmt.Sprintf("--registry-mirror=%v", registryMirror))
+	}
+
+	// allow pulling from registries served over plain http or with self-signed certificates
+	for _, insecureRegistry := range dr.insecureRegistries {
+		args = append(args, fmt.Sprintf("--insecure-registry=%v", insecureRegistry))
+	}
+
+	return args
+}
+
+// getDockerHost returns the address the docker client connects to
+func (dr *dockerRunnerImpl) getDockerHost() string {
+	if dr.manageDaemon {
+		return dr.dockerHosts[0]
+	}
+	if dockerHost := os.Getenv("DOCKER_HOST"); dockerHost != "" {
+		return dockerHost
+	}
+	return client.DefaultDockerHost
+}
+
+// removeStaleDaemonFiles removes the pid files and sockets left behind by a docker daemon that didn't shut down cleanly,
+// since dockerd refuses to start while its pid file exists; the heater's own daemon isn't running at this point
+func (dr *dockerRunnerImpl) removeStaleDaemonFiles() {
+	files := []string{dockerPidFile, containerdPidFile, containerdSocket}
+	for _, dockerHost := range dr.dockerHosts {
+		if strings.HasPrefix(dockerHost, "unix://") {
+			files = append(files, strings.TrimPrefix(dockerHost, "unix://"))
+		}
+	}
+
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		log.Warn().Msgf("Removing stale docker daemon file %v", file)
+		if err := os.Remove(file); err != nil {
+			log.Warn().Err(err).Msgf("Failed removing stale docker daemon file %v", file)
+		}
+	}
+}
+
+// killDockerDaemon stops a docker daemon that failed to become ready, so it can be started again
+func (dr *dockerRunnerImpl) killDockerDaemon() {
+	if dr.dockerDaemonCommand == nil || dr.dockerDaemonCommand.Process == nil {
+		return
+	}
+
+	select {
+	case <-dr.dockerDaemonExited:
+		// already exited
+	default:
+		dr.dockerDaemonCommand.Process.Kill()
+		<-dr.dockerDaemonExited
+	}
+}
+
+func (dr *dockerRunnerImpl) isDockerDaemonReady(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := dr.dockerClient.Ping(ctx)
+	return err == nil
+}
+
+func (dr *dockerRunnerImpl) runDockerLogin(ctx context.Context, credentials RegistryCredentials) (err error) {
+
+	// there's nothing to log in with
+	if credentials.Username == "" || credentials.DockerConfigPath != "" {
+		return
+	}
+
+	return dr.registryLogins.login(credentials, func(registry string) error {
+		authConfig, err := getAuthConfig(credentials)
+		if err != nil {
+			return err
+		}
+
+		if dr.contentTrust {
+			// the docker cli doesn't use the daemon's login but its own config file
+			return dr.runDockerCLILogin(ctx, authConfig)
+		}
+		_, err = dr.dockerClient.RegistryLogin(ctx, authConfig)
+		return err
+	})
+}
+
+func (dr *dockerRunnerImpl) runDockerPull(ctx context.Context, container Container, credentials *RegistryCredentials) (downloadedBytes int64, err error) {
+
+	containerImage := container.Image
+
+	if dr.dryRun {
+		args := []string{"docker", "pull"}
+		if dr.contentTrust {
+			args = append([]string{"DOCKER_CONTENT_TRUST=1"}, args...)
+		}
+		if container.Platform != "" {
+			args = append(args, "--platform", container.Platform)
+		}
+		args = append(args, containerImage)
+		log.Info().Msgf("Dry run: %v", strings.Join(args, " "))
+		return
+	}
+
+	// docker hub images are pulled from the mirrors that require authentication first, falling back to the daemon's
+	// own mirrors and docker hub
+	var mirrorDownloadedBytes int64
+	if dr.useMirrorCredentials(containerImage) {
+		mirrorDownloadedBytes, err = dr.runMirrorDockerPull(ctx, container)
+		if err == nil && !dr.contentTrust {
+			return mirrorDownloadedBytes, nil
+		}
+	}
+
+	if dr.contentTrust {
+		// the image pulled from a mirror only saves downloading the layers, the signature is verified by the trusted pull
+		downloadedBytes, err = dr.runTrustedDockerPull(ctx, container, credentials)
+		return downloadedBytes + mirrorDownloadedBytes, err
+	}
+
+	pullOptions := types.ImagePullOptions{
+		Platform: container.Platform,
+	}
+
+	if credentials != nil {
+		pullOptions.RegistryAuth, err = dr.getRegistryAuth(ctx, *credentials)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed pulling container image '%v'", containerImage)
+			return
+		}
+	}
+
+	downloadedBytes, err = pullWithRetries(ctx, dr.jitter, container, dr.pullMaxRetries, dr.retryRateLimitedPulls, dr.quietPulls, func(ctx context.Context) (int64, error) {
+		return dr.runDockerPullAttempt(ctx, containerImage, pullOptions)
+	})
+
+	return
+}
+
+// pullWithRetries runs the pull attempt until it succeeds, retrying errors that may go away with exponential backoff;
+// quiet pulls only log a single line for each successfully pulled image
+func pullWithRetries(ctx context.Context, jitter *jitter, container Container, pullMaxRetries int, retryRateLimited bool, quiet bool, pullAttempt func(ctx context.Context) (int64, error)) (downloadedBytes int64, err error) {
+
+	containerImage := container.Image
+	start := time.Now()
+
+	// the container can override the number of retries
+	if container.PullMaxRetries != nil {
+		pullMaxRetries = *container.PullMaxRetries
+	}
+
+	for attempt := 0; attempt <= pullMaxRetries; attempt++ {
+		if attempt > 0 {
+			// back off exponentially to give the registry time to recover
+			backoffSeconds := jitter.apply(pullRetryBackoffSeconds * int(math.Pow(2, float64(attempt-1))))
+			log.Info().Msgf("Retrying pull of docker image '%v' in %v seconds (attempt %v of %v)...", containerImage, backoffSeconds, attempt+1, pullMaxRetries+1)
+			select {
+			case <-time.After(time.Duration(backoffSeconds) * time.Second):
+			case <-ctx.Done():
+				log.Warn().Msgf("Cancelled pulling container image '%v'", containerImage)
+				return 0, ctx.Err()
+			}
+		}
+
+		if !quiet {
+			log.Info().Msgf("Pulling docker image '%v'", containerImage)
+		}
+
+		downloadedBytes, err = pullAttempt(ctx)
+		if err == nil {
+			if quiet {
+				log.Info().
+					Str("image", containerImage).
+					Int64("downloadedBytes", downloadedBytes).
+					Float64("durationSeconds", time.Since(start).Seconds()).
+					Msgf("Pulled image '%v' in %v", containerImage, time.Since(start).Round(time.Millisecond))
+			}
+			return
+		}
+
+		if ctx.Err() != nil {
+			log.Warn().Err(err).Msgf("Cancelled pulling container image '%v'", containerImage)
+			return
+		}
+
+		if !isRetryablePullError(err, retryRateLimited) {
+			log.Warn().Err(err).Msgf("Failed pulling container image '%v', not retrying", containerImage)
+			return
+		}
+	}
+
+	log.Warn().Err(err).Msgf("Failed pulling container image '%v'", containerImage)
+
+	return
 }
 
-func (dr *dockerRunnerImpl) runDockerPull(containerImage string) (err error) {
+// runTrustedDockerPull pulls with the docker cli with content trust enabled, since verifying signatures is done by the
+// cli instead of the daemon
+func (dr *dockerRunnerImpl) runTrustedDockerPull(ctx context.Context, container Container, credentials *RegistryCredentials) (downloadedBytes int64, err error) {
 
-	log.Info().Msgf("Pulling docker image '%v'", containerImage)
+	if credentials != nil {
+		err = dr.runDockerLogin(ctx, *credentials)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed pulling container image '%v'", container.Image)
+			return
+		}
+	}
 
-	pullArgs := []string{
-		"pull",
-		containerImage,
+	args := []string{"--host", dr.getDockerHost(), "pull"}
+	if container.Platform != "" {
+		args = append(args, "--platform", container.Platform)
 	}
-	err = runCommandExtended("docker", pullArgs)
+	args = append(args, container.Image)
+
+	return pullWithRetries(ctx, dr.jitter, container, dr.pullMaxRetries, dr.retryRateLimitedPulls, dr.quietPulls, func(ctx context.Context) (int64, error) {
+		// cancel the pull once it exceeds the timeout, so a hanging pull doesn't block the heating cycle
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(dr.pullTimeoutSeconds)*time.Second)
+		defer cancel()
+
+		cmd := dr.execCommand(ctx, "docker", args...)
+		cmd.Env = append(os.Environ(), "DOCKER_CONTENT_TRUST=1")
+		if credentials != nil && credentials.DockerConfigPath != "" {
+			// the cli reads the credentials from the config.json file in the DOCKER_CONFIG directory
+			cmd.Env = append(cmd.Env, fmt.Sprintf("DOCKER_CONFIG=%v", filepath.Dir(credentials.DockerConfigPath)))
+		}
+
+		// the cli doesn't report the number of downloaded bytes
+		_, err := runCommand(cmd)
+		if err != nil && isUntrustedImageError(err) {
+			return 0, untrustedImageError{image: container.Image, err: err}
+		}
+		return 0, err
+	})
+}
+
+// runDockerCLILogin stores the credentials in the docker cli's config file for pulls with content trust; the
+// password is passed on stdin, so it doesn't show up in the process list
+func (dr *dockerRunnerImpl) runDockerCLILogin(ctx context.Context, authConfig types.AuthConfig) error {
+	cmd := dr.execCommand(ctx, "docker", "--host", dr.getDockerHost(), "login", "--username", authConfig.Username, "--password-stdin", authConfig.ServerAddress)
+	cmd.Stdin = strings.NewReader(authConfig.Password)
+	_, err := runCommand(cmd)
+	return err
+}
+
+// getRegistryAuth logs in with the credentials and returns them encoded for pulling
+func (dr *dockerRunnerImpl) getRegistryAuth(ctx context.Context, credentials RegistryCredentials) (string, error) {
+
+	err := dr.runDockerLogin(ctx, credentials)
+	if err != nil {
+		return "", err
+	}
+
+	authConfig, err := getAuthConfig(credentials)
 	if err != nil {
-		log.Warn().Err(err).Msgf("Failed pulling container image '%v'", containerImage)
+		return "", err
 	}
 
+	return encodeAuthConfig(authConfig)
+}
+
+// useMirrorCredentials returns true for docker hub images with a tag when registry mirrors require authentication;
+// the docker daemon would send the credentials of the pull to docker hub as well when falling back from its mirrors,
+// so the heater pulls from those mirrors itself, and images pinned by digest can't be tagged with their docker hub name
+func (dr *dockerRunnerImpl) useMirrorCredentials(containerImage string) bool {
+	return len(dr.registryMirrorCredentials) > 0 && getImageRegistry(containerImage) == "docker.io" && !strings.Contains(containerImage, "@")
+}
+
+// getDaemonRegistryMirrors returns the registry mirrors the docker daemon pulls through, the ones that don't require
+// authentication
+func (dr *dockerRunnerImpl) getDaemonRegistryMirrors() (registryMirrors []string) {
+	for _, registryMirror := range dr.registryMirrors {
+		if _, ok := dr.registryMirrorCredentials[normalizeRegistry(registryMirror)]; !ok {
+			registryMirrors = append(registryMirrors, registryMirror)
+		}
+	}
 	return
 }
 
-func (dr *dockerRunnerImpl) runDockerRemoveImage(containerImage string) (err error) {
+// runMirrorDockerPull pulls a docker hub image from the registry mirrors that require authentication in order, with the
+// credentials of each mirror, and tags it with its docker hub name
+func (dr *dockerRunnerImpl) runMirrorDockerPull(ctx context.Context, container Container) (downloadedBytes int64, err error) {
 
-	log.Info().Msgf("Removing docker image '%v'", containerImage)
+	for _, registryMirror := range dr.registryMirrors {
+		credentials, ok := dr.registryMirrorCredentials[normalizeRegistry(registryMirror)]
+		if !ok {
+			continue
+		}
+
+		mirrorImage := getMirrorImage(credentials.Registry, container.Image)
+
+		authConfig, err := getAuthConfig(credentials)
+		if err != nil {
+			return 0, err
+		}
+		registryAuth, err := encodeAuthConfig(authConfig)
+		if err != nil {
+			return 0, err
+		}
+		pullOptions := types.ImagePullOptions{
+			Platform:     container.Platform,
+			RegistryAuth: registryAuth,
+		}
+
+		// falling back to the next mirror or docker hub takes the place of retries
+		noRetries := 0
+		mirrorContainer := container
+		mirrorContainer.Image = mirrorImage
+		mirrorContainer.PullMaxRetries = &noRetries
+
+		downloadedBytes, err = pullWithRetries(ctx, dr.jitter, mirrorContainer, 0, dr.retryRateLimitedPulls, dr.quietPulls, func(ctx context.Context) (int64, error) {
+			return dr.runDockerPullAttempt(ctx, mirrorImage, pullOptions)
+		})
+		if err == nil {
+			err = dr.tagMirrorImage(ctx, mirrorImage, container.Image)
+		}
+		if err == nil || ctx.Err() != nil {
+			return downloadedBytes, err
+		}
+
+		log.Warn().Err(err).Msgf("Failed pulling container image '%v' from registry mirror %v", container.Image, credentials.Registry)
+	}
+
+	return 0, fmt.Errorf("Failed pulling container image '%v' from the registry mirrors with credentials", container.Image)
+}
+
+// tagMirrorImage tags the image pulled from a mirror with its docker hub name and removes the mirror's tag, so it's
+// found under the same name as when the daemon pulled it through the mirror
+func (dr *dockerRunnerImpl) tagMirrorImage(ctx context.Context, mirrorImage, containerImage string) error {
+
+	err := dr.dockerClient.ImageTag(ctx, mirrorImage, containerImage)
+	if err != nil {
+		return fmt.Errorf("Failed tagging image %v as %v: %v", mirrorImage, containerImage, err)
+	}
+
+	// with the docker hub tag in place this only removes the mirror's tag, not the image
+	_, err = dr.dockerClient.ImageRemove(ctx, mirrorImage, types.ImageRemoveOptions{})
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed removing tag of image %v", mirrorImage)
+	}
+
+	return nil
+}
+
+// getMirrorImage returns the name of a docker hub image in a registry mirror
+func getMirrorImage(mirror, containerImage string) string {
+	return fmt.Sprintf("%v/%v:%v", mirror, getImageRepository(containerImage), getImageReference(containerImage))
+}
+
+// runDockerPullAttempt cancels the pull once it exceeds the timeout, so a hanging pull doesn't block the heating cycle
+func (dr *dockerRunnerImpl) runDockerPullAttempt(ctx context.Context, containerImage string, pullOptions types.ImagePullOptions) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(dr.pullTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	reader, err := dr.dockerClient.ImagePull(ctx, containerImage, pullOptions)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	// the pull only finishes once the progress stream is read to the end; errors during the pull are reported in the stream
+	return newPullProgressLogger(containerImage, dr.pullProgress, dr.quietPulls).read(reader)
+}
+
+// isRetryablePullError returns false for errors that won't go away by pulling again, like a missing image
+func isRetryablePullError(err error, retryRateLimited bool) bool {
+	if _, ok := err.(untrustedImageError); ok {
+		return false
+	}
+
+	// rate limits take a while to reset, with a cooldown the heater skips the registry's images instead of retrying
+	if isRateLimitedError(err) {
+		return retryRateLimited
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, nonRetryableMessage := range nonRetryablePullErrors {
+		if strings.Contains(message, nonRetryableMessage) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isNoSpaceLeftError returns true if the pull failed because the disk of the docker daemon is full
+func isNoSpaceLeftError(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), noSpaceLeftError)
+}
+
+// runDockerLoad loads an image from a tarball created with docker save, for when it can't be pulled
+func (dr *dockerRunnerImpl) runDockerLoad(ctx context.Context, containerImage, tarballPath string) (err error) {
 
-	pullArgs := []string{
-		"rmi",
-		containerImage,
+	if dr.dryRun {
+		log.Info().Msgf("Dry run: docker load --input %v", tarballPath)
+		return
 	}
-	err = runCommandExtended("docker", pullArgs)
+
+	log.Info().Msgf("Loading docker image '%v' from %v", containerImage, tarballPath)
+
+	tarball, err := os.Open(tarballPath)
+	if err != nil {
+		return
+	}
+	defer tarball.Close()
+
+	resp, err := dr.dockerClient.ImageLoad(ctx, tarball, true)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	// errors during the load are reported in the stream, like for a pull
+	_, err = newPullProgressLogger(containerImage, false, true).read(resp.Body)
+
+	return
+}
+
+func (dr *dockerRunnerImpl) runDockerRemoveImage(ctx context.Context, containerImage string) (err error) {
+
+	if dr.dryRun {
+		log.Info().Msgf("Dry run: docker rmi %v", containerImage)
+		return
+	}
+
+	log.Info().Msgf("Removing docker image '%v'", containerImage)
+
+	_, err = dr.dockerClient.ImageRemove(ctx, containerImage, types.ImageRemoveOptions{
+		PruneChildren: true,
+	})
 	if err != nil {
 		log.Warn().Err(err).Msgf("Failed removing container image '%v'", containerImage)
 	}
@@ -111,20 +866,161 @@ func (dr *dockerRunnerImpl) runDockerRemoveImage(containerImage string) (err err
 	return
 }
 
-func (dr *dockerRunnerImpl) runDockerSystemPrune() (err error) {
+// getImageDigests returns the digests the registry reported for a pulled image
+func (dr *dockerRunnerImpl) getImageDigests(ctx context.Context, containerImage string) (digests []string, err error) {
+
+	imageInspect, _, err := dr.dockerClient.ImageInspectWithRaw(ctx, containerImage)
+	if err != nil {
+		return
+	}
+
+	// repo digests are in the form repository@sha256:...
+	for _, repoDigest := range imageInspect.RepoDigests {
+		if i := strings.Index(repoDigest, "@"); i >= 0 {
+			digests = append(digests, repoDigest[i+1:])
+		}
+	}
+
+	return
+}
+
+func (dr *dockerRunnerImpl) getImageSize(ctx context.Context, containerImage string) (int64, error) {
+
+	imageInspect, _, err := dr.dockerClient.ImageInspectWithRaw(ctx, containerImage)
+	if err != nil {
+		return 0, err
+	}
+
+	return imageInspect.Size, nil
+}
+
+func (dr *dockerRunnerImpl) listImages(ctx context.Context) (images []localImage, err error) {
+
+	imageSummaries, err := dr.dockerClient.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		return
+	}
+
+	for _, imageSummary := range imageSummaries {
+		images = append(images, localImage{
+			ID:          imageSummary.ID,
+			RepoTags:    imageSummary.RepoTags,
+			RepoDigests: imageSummary.RepoDigests,
+		})
+	}
+
+	return
+}
+
+func (dr *dockerRunnerImpl) runDockerSystemPrune(ctx context.Context, keepImages []string) (err error) {
+
+	if dr.dryRun {
+		volumesArg := ""
+		if dr.pruneVolumes {
+			volumesArg = " --volumes"
+		}
+		log.Info().Strs("keepImages", keepImages).Bool("pruneBuildCache", dr.pruneBuildCache).Msgf("Dry run: docker system prune --all --force --filter label!=%v%v", keepLabel, volumesArg)
+		return
+	}
+
+	dr.keepImages(ctx, keepImages)
 
 	log.Info().Msg("Pruning docker system")
 
-	pullArgs := []string{
-		"system",
-		"prune",
-		"--all",
-		"--force",
+	// prune the same as docker system prune --all does, skipping the containers that keep images
+	pruneFilters := filters.NewArgs(filters.Arg("label!", keepLabel))
+
+	containersReport, err := dr.dockerClient.ContainersPrune(ctx, pruneFilters)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed pruning containers")
+		return
+	}
+
+	networksReport, err := dr.dockerClient.NetworksPrune(ctx, pruneFilters)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed pruning networks")
+		return
+	}
+
+	imagesReport, err := dr.dockerClient.ImagesPrune(ctx, filters.NewArgs(filters.Arg("dangling", "false")))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed pruning images")
+		return
+	}
+
+	buildCacheReport := &types.BuildCachePruneReport{}
+	if dr.pruneBuildCache {
+		buildCacheReport, err = dr.dockerClient.BuildCachePrune(ctx, types.BuildCachePruneOptions{All: true})
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed pruning build cache")
+			return
+		}
+	}
+
+	volumesReport := types.VolumesPruneReport{}
+	if dr.pruneVolumes {
+		volumesReport, err = dr.dockerClient.VolumesPrune(ctx, filters.NewArgs())
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed pruning volumes")
+			return
+		}
+	}
+
+	log.Info().
+		Int("containers", len(containersReport.ContainersDeleted)).
+		Int("networks", len(networksReport.NetworksDeleted)).
+		Int("images", len(imagesReport.ImagesDeleted)).
+		Int("volumes", len(volumesReport.VolumesDeleted)).
+		Uint64("reclaimedBytes", containersReport.SpaceReclaimed+imagesReport.SpaceReclaimed+buildCacheReport.SpaceReclaimed+volumesReport.SpaceReclaimed).
+		Msg("Pruned docker system")
+
+	return
+}
+
+func (dr *dockerRunnerImpl) runDockerImagePrune(ctx context.Context) (err error) {
+
+	if dr.dryRun {
+		log.Info().Msg("Dry run: docker image prune --force")
+		return
 	}
-	err = runCommandExtended("docker", pullArgs)
+
+	log.Info().Msg("Pruning dangling docker images")
+
+	report, err := dr.dockerClient.ImagesPrune(ctx, filters.NewArgs(filters.Arg("dangling", "true")))
 	if err != nil {
-		log.Warn().Err(err).Msg("Failed pruning system")
+		log.Warn().Err(err).Msg("Failed pruning dangling images")
+		return
 	}
 
+	log.Info().
+		Int("images", len(report.ImagesDeleted)).
+		Uint64("reclaimedBytes", report.SpaceReclaimed).
+		Msg("Pruned dangling docker images")
+
 	return
 }
+
+// keepImages protects images from pruning by creating a labeled container for each of them, since prune skips both the
+// labeled containers and the images in use by any container
+func (dr *dockerRunnerImpl) keepImages(ctx context.Context, keepImages []string) {
+
+	// remove the containers for the previous set of images to keep, so images no longer kept are pruned
+	_, err := dr.dockerClient.ContainersPrune(ctx, filters.NewArgs(filters.Arg("label", keepLabel)))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed removing containers for images to keep")
+	}
+
+	for _, containerImage := range keepImages {
+		log.Info().Msgf("Keeping docker image '%v' when pruning", containerImage)
+
+		// the container is never started, so the command doesn't have to exist in the image
+		_, err := dr.dockerClient.ContainerCreate(ctx, &container.Config{
+			Image:  containerImage,
+			Cmd:    []string{"keep"},
+			Labels: map[string]string{keepLabel: ""},
+		}, nil, nil, "")
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed keeping container image '%v' when pruning", containerImage)
+		}
+	}
+}
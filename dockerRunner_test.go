@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+)
+
+// fakeDockerClient records the calls of the docker runner instead of talking to a daemon; calls it doesn't implement
+// panic on the nil embedded interface
+type fakeDockerClient struct {
+	dockerAPIClient
+
+	calls []string
+
+	pulls         []fakeImagePull
+	pullErrors    map[string]error
+	removedImages []fakeImageRemove
+	taggedImages  [][2]string
+	keptImages    []string
+	pruneFilters  map[string]filters.Args
+}
+
+type fakeImagePull struct {
+	ref     string
+	options types.ImagePullOptions
+}
+
+type fakeImageRemove struct {
+	image   string
+	options types.ImageRemoveOptions
+}
+
+func newFakeDockerClient() *fakeDockerClient {
+	return &fakeDockerClient{
+		pullErrors:   map[string]error{},
+		pruneFilters: map[string]filters.Args{},
+	}
+}
+
+func (c *fakeDockerClient) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	c.calls = append(c.calls, "ImagePull")
+	c.pulls = append(c.pulls, fakeImagePull{ref: ref, options: options})
+	if err := c.pullErrors[ref]; err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(strings.NewReader(`{"status":"Status: Downloaded newer image"}`)), nil
+}
+
+func (c *fakeDockerClient) ImageTag(ctx context.Context, source, target string) error {
+	c.calls = append(c.calls, "ImageTag")
+	c.taggedImages = append(c.taggedImages, [2]string{source, target})
+	return nil
+}
+
+func (c *fakeDockerClient) ImageRemove(ctx context.Context, image string, options types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error) {
+	c.calls = append(c.calls, "ImageRemove")
+	c.removedImages = append(c.removedImages, fakeImageRemove{image: image, options: options})
+	return nil, nil
+}
+
+func (c *fakeDockerClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error) {
+	c.calls = append(c.calls, "ContainerCreate")
+	if _, ok := config.Labels[keepLabel]; ok {
+		c.keptImages = append(c.keptImages, config.Image)
+	}
+	return container.ContainerCreateCreatedBody{}, nil
+}
+
+func (c *fakeDockerClient) ContainersPrune(ctx context.Context, pruneFilters filters.Args) (types.ContainersPruneReport, error) {
+	c.calls = append(c.calls, "ContainersPrune")
+	c.pruneFilters["containers"] = pruneFilters
+	return types.ContainersPruneReport{}, nil
+}
+
+func (c *fakeDockerClient) NetworksPrune(ctx context.Context, pruneFilters filters.Args) (types.NetworksPruneReport, error) {
+	c.calls = append(c.calls, "NetworksPrune")
+	c.pruneFilters["networks"] = pruneFilters
+	return types.NetworksPruneReport{}, nil
+}
+
+func (c *fakeDockerClient) ImagesPrune(ctx context.Context, pruneFilters filters.Args) (types.ImagesPruneReport, error) {
+	c.calls = append(c.calls, "ImagesPrune")
+	c.pruneFilters["images"] = pruneFilters
+	return types.ImagesPruneReport{}, nil
+}
+
+func (c *fakeDockerClient) BuildCachePrune(ctx context.Context, opts types.BuildCachePruneOptions) (*types.BuildCachePruneReport, error) {
+	c.calls = append(c.calls, "BuildCachePrune")
+	return &types.BuildCachePruneReport{}, nil
+}
+
+func (c *fakeDockerClient) VolumesPrune(ctx context.Context, pruneFilters filters.Args) (types.VolumesPruneReport, error) {
+	c.calls = append(c.calls, "VolumesPrune")
+	c.pruneFilters["volumes"] = pruneFilters
+	return types.VolumesPruneReport{}, nil
+}
+
+// fakeCommands records the processes the docker runner creates and runs true instead
+type fakeCommands struct {
+	commands []*exec.Cmd
+	args     [][]string
+}
+
+func (fc *fakeCommands) execCommand(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	fc.args = append(fc.args, append([]string{name}, arg...))
+	cmd := exec.CommandContext(ctx, "true")
+	fc.commands = append(fc.commands, cmd)
+	return cmd
+}
+
+func newTestDockerRunner(config dockerRunnerConfig) (*dockerRunnerImpl, *fakeDockerClient, *fakeCommands) {
+	dockerClient := newFakeDockerClient()
+	commands := &fakeCommands{}
+	config.dockerHosts = []string{"unix:///var/run/docker.sock"}
+	config.pullTimeoutSeconds = 60
+	config.quietPulls = true
+
+	return newDockerRunnerImpl(newJitter(0, rand.NewSource(1)), config, dockerClient, commands.execCommand), dockerClient, commands
+}
+
+func TestRunDockerPull(t *testing.T) {
+
+	t.Run("PullsImageForPlatform", func(t *testing.T) {
+		dr, dockerClient, _ := newTestDockerRunner(dockerRunnerConfig{})
+
+		_, err := dr.runDockerPull(context.Background(), Container{Image: "estafette/app:1.0.0", Platform: "linux/arm64"}, nil)
+
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		expected := []fakeImagePull{{ref: "estafette/app:1.0.0", options: types.ImagePullOptions{Platform: "linux/arm64"}}}
+		if !reflect.DeepEqual(dockerClient.pulls, expected) {
+			t.Errorf("Expected pulls %+v, got %+v", expected, dockerClient.pulls)
+		}
+	})
+
+	t.Run("PullsWithRegistryAuthOfCredentials", func(t *testing.T) {
+		dr, dockerClient, _ := newTestDockerRunner(dockerRunnerConfig{})
+		// a logged in registry doesn't log in again
+		credentials := RegistryCredentials{Registry: "gcr.io", Username: "user", Password: "secret"}
+		dr.registryLogins.credentials["gcr.io"] = credentials
+
+		_, err := dr.runDockerPull(context.Background(), Container{Image: "gcr.io/estafette/app:1.0.0"}, &credentials)
+
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(dockerClient.pulls) != 1 {
+			t.Fatalf("Expected 1 pull, got %v", len(dockerClient.pulls))
+		}
+		authConfig := decodeTestAuthConfig(t, dockerClient.pulls[0].options.RegistryAuth)
+		if authConfig.Username != "user" || authConfig.Password != "secret" || authConfig.ServerAddress != "gcr.io" {
+			t.Errorf("Expected the credentials for gcr.io, got %+v", authConfig)
+		}
+	})
+
+	t.Run("PullsWithDockerCLIWithContentTrust", func(t *testing.T) {
+		dr, dockerClient, commands := newTestDockerRunner(dockerRunnerConfig{contentTrust: true})
+
+		_, err := dr.runDockerPull(context.Background(), Container{Image: "estafette/app:1.0.0", Platform: "linux/arm64"}, nil)
+
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(dockerClient.pulls) != 0 {
+			t.Errorf("Expected no pulls through the api, got %+v", dockerClient.pulls)
+		}
+		expected := [][]string{{"docker", "--host", "unix:///var/run/docker.sock", "pull", "--platform", "linux/arm64", "estafette/app:1.0.0"}}
+		if !reflect.DeepEqual(commands.args, expected) {
+			t.Fatalf("Expected commands %v, got %v", expected, commands.args)
+		}
+		if !containsString(commands.commands[0].Env, "DOCKER_CONTENT_TRUST=1") {
+			t.Errorf("Expected DOCKER_CONTENT_TRUST=1 in the environment of the pull")
+		}
+	})
+
+	t.Run("DoesNothingInDryRun", func(t *testing.T) {
+		dr, dockerClient, commands := newTestDockerRunner(dockerRunnerConfig{dryRun: true})
+
+		_, err := dr.runDockerPull(context.Background(), Container{Image: "estafette/app:1.0.0"}, nil)
+
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(dockerClient.calls) != 0 || len(commands.args) != 0 {
+			t.Errorf("Expected no calls in dry run, got %v and %v", dockerClient.calls, commands.args)
+		}
+	})
+}
+
+func TestRunDockerRemoveImage(t *testing.T) {
+	dr, dockerClient, _ := newTestDockerRunner(dockerRunnerConfig{})
+
+	err := dr.runDockerRemoveImage(context.Background(), "estafette/app:1.0.0")
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []fakeImageRemove{{image: "estafette/app:1.0.0", options: types.ImageRemoveOptions{PruneChildren: true}}}
+	if !reflect.DeepEqual(dockerClient.removedImages, expected) {
+		t.Errorf("Expected removed images %+v, got %+v", expected, dockerClient.removedImages)
+	}
+}
+
+func TestRunDockerSystemPrune(t *testing.T) {
+
+	t.Run("PrunesAllExceptKeptImages", func(t *testing.T) {
+		dr, dockerClient, _ := newTestDockerRunner(dockerRunnerConfig{pruneBuildCache: true})
+
+		err := dr.runDockerSystemPrune(context.Background(), []string{"estafette/app:1.0.0"})
+
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		expectedCalls := []string{"ContainersPrune", "ContainerCreate", "ContainersPrune", "NetworksPrune", "ImagesPrune", "BuildCachePrune"}
+		if !reflect.DeepEqual(dockerClient.calls, expectedCalls) {
+			t.Errorf("Expected calls %v, got %v", expectedCalls, dockerClient.calls)
+		}
+		if !reflect.DeepEqual(dockerClient.keptImages, []string{"estafette/app:1.0.0"}) {
+			t.Errorf("Expected a container keeping estafette/app:1.0.0, got %v", dockerClient.keptImages)
+		}
+		if !dockerClient.pruneFilters["containers"].ExactMatch("label!", keepLabel) {
+			t.Errorf("Expected the containers keeping images to be skipped, got filters %v", dockerClient.pruneFilters["containers"])
+		}
+		if !dockerClient.pruneFilters["images"].ExactMatch("dangling", "false") {
+			t.Errorf("Expected all unused images to be pruned, got filters %v", dockerClient.pruneFilters["images"])
+		}
+	})
+
+	t.Run("PrunesVolumesWithoutBuildCache", func(t *testing.T) {
+		dr, dockerClient, _ := newTestDockerRunner(dockerRunnerConfig{pruneVolumes: true})
+
+		err := dr.runDockerSystemPrune(context.Background(), nil)
+
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		expectedCalls := []string{"ContainersPrune", "ContainersPrune", "NetworksPrune", "ImagesPrune", "VolumesPrune"}
+		if !reflect.DeepEqual(dockerClient.calls, expectedCalls) {
+			t.Errorf("Expected calls %v, got %v", expectedCalls, dockerClient.calls)
+		}
+	})
+}
+
+func TestRunDockerImagePrune(t *testing.T) {
+	dr, dockerClient, _ := newTestDockerRunner(dockerRunnerConfig{})
+
+	err := dr.runDockerImagePrune(context.Background())
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !dockerClient.pruneFilters["images"].ExactMatch("dangling", "true") {
+		t.Errorf("Expected only dangling images to be pruned, got filters %v", dockerClient.pruneFilters["images"])
+	}
+}
+
+func decodeTestAuthConfig(t *testing.T, registryAuth string) (authConfig types.AuthConfig) {
+	data, err := base64.URLEncoding.DecodeString(registryAuth)
+	if err != nil {
+		t.Fatalf("Failed decoding registry auth: %v", err)
+	}
+	if err = json.Unmarshal(data, &authConfig); err != nil {
+		t.Fatalf("Failed unmarshaling registry auth: %v", err)
+	}
+	return
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRunDockerPullWithRegistryMirrorCredentials(t *testing.T) {
+
+	config := dockerRunnerConfig{
+		registryMirrors: []string{"https://mirror-a.example.com", "https://mirror-b.example.com", "https://mirror-c.example.com"},
+		registryMirrorCredentials: map[string]RegistryCredentials{
+			"mirror-a.example.com": {Registry: "mirror-a.example.com", Username: "user-a", Password: "secret-a"},
+			"mirror-b.example.com": {Registry: "mirror-b.example.com", Username: "user-b", Password: "secret-b"},
+		},
+	}
+
+	t.Run("PullsFromMirrorWithItsCredentialsAndTagsDockerHubName", func(t *testing.T) {
+		dr, dockerClient, _ := newTestDockerRunner(config)
+		dockerClient.pullErrors["mirror-a.example.com/library/nginx:1.17"] = fmt.Errorf("unauthorized")
+
+		_, err := dr.runDockerPull(context.Background(), Container{Image: "nginx:1.17"}, nil)
+
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(dockerClient.pulls) != 2 {
+			t.Fatalf("Expected 2 pulls, got %+v", dockerClient.pulls)
+		}
+		if dockerClient.pulls[1].ref != "mirror-b.example.com/library/nginx:1.17" {
+			t.Errorf("Expected a pull from mirror-b, got %v", dockerClient.pulls[1].ref)
+		}
+		authConfig := decodeTestAuthConfig(t, dockerClient.pulls[1].options.RegistryAuth)
+		if authConfig.Username != "user-b" || authConfig.ServerAddress != "mirror-b.example.com" {
+			t.Errorf("Expected the credentials of mirror-b, got %+v", authConfig)
+		}
+		expectedTags := [][2]string{{"mirror-b.example.com/library/nginx:1.17", "nginx:1.17"}}
+		if !reflect.DeepEqual(dockerClient.taggedImages, expectedTags) {
+			t.Errorf("Expected tags %v, got %v", expectedTags, dockerClient.taggedImages)
+		}
+		if len(dockerClient.removedImages) != 1 || dockerClient.removedImages[0].image != "mirror-b.example.com/library/nginx:1.17" {
+			t.Errorf("Expected the mirror's tag to be removed, got %+v", dockerClient.removedImages)
+		}
+	})
+
+	t.Run("FallsBackToDaemonWithoutMirrorCredentials", func(t *testing.T) {
+		dr, dockerClient, _ := newTestDockerRunner(config)
+		dockerClient.pullErrors["mirror-a.example.com/library/nginx:1.17"] = fmt.Errorf("not found")
+		dockerClient.pullErrors["mirror-b.example.com/library/nginx:1.17"] = fmt.Errorf("not found")
+
+		_, err := dr.runDockerPull(context.Background(), Container{Image: "nginx:1.17"}, nil)
+
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(dockerClient.pulls) != 3 {
+			t.Fatalf("Expected 3 pulls, got %+v", dockerClient.pulls)
+		}
+		if dockerClient.pulls[2].ref != "nginx:1.17" || dockerClient.pulls[2].options.RegistryAuth != "" {
+			t.Errorf("Expected an anonymous pull through the daemon, got %+v", dockerClient.pulls[2])
+		}
+	})
+
+	t.Run("PullsOtherRegistriesAndDigestsThroughDaemon", func(t *testing.T) {
+		dr, dockerClient, _ := newTestDockerRunner(config)
+
+		for _, image := range []string{"gcr.io/estafette/app:1.0.0", "nginx@sha256:1b3c5b4c0b3b1c8d3c4a5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b"} {
+			_, err := dr.runDockerPull(context.Background(), Container{Image: image}, nil)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+		}
+
+		if len(dockerClient.pulls) != 2 || dockerClient.pulls[0].ref != "gcr.io/estafette/app:1.0.0" || !strings.HasPrefix(dockerClient.pulls[1].ref, "nginx@") {
+			t.Errorf("Expected the images to be pulled through the daemon, got %+v", dockerClient.pulls)
+		}
+	})
+
+	t.Run("OnlyPassesMirrorsWithoutCredentialsToDaemon", func(t *testing.T) {
+		dr, _, _ := newTestDockerRunner(config)
+
+		expected := []string{"https://mirror-c.example.com"}
+		if !reflect.DeepEqual(dr.getDaemonRegistryMirrors(), expected) {
+			t.Errorf("Expected daemon mirrors %v, got %v", expected, dr.getDaemonRegistryMirrors())
+		}
+	})
+}
+
+func TestIsRetryablePullError(t *testing.T) {
+
+	rateLimited := fmt.Errorf("toomanyrequests: You have reached your pull rate limit")
+
+	t.Run("RetriesRateLimitedPullsWithoutCooldown", func(t *testing.T) {
+		if !isRetryablePullError(rateLimited, true) {
+			t.Errorf("Expected a rate limited pull to be retried without a cooldown")
+		}
+	})
+
+	t.Run("DoesNotRetryRateLimitedPullsWithCooldown", func(t *testing.T) {
+		if isRetryablePullError(rateLimited, false) {
+			t.Errorf("Expected a rate limited pull not to be retried with a cooldown")
+		}
+	})
+
+	t.Run("DoesNotRetryUntrustedImages", func(t *testing.T) {
+		if isRetryablePullError(untrustedImageError{image: "estafette/app:1.0.0", err: fmt.Errorf("no trust data")}, true) {
+			t.Errorf("Expected an untrusted image not to be retried")
+		}
+	})
+}
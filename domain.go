@@ -1,5 +1,352 @@
 package main
 
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	// a simplified version of the grammar for image references in github.com/docker/distribution/reference
+	imageReferenceRegex = regexp.MustCompile(`^` +
+		// optional registry host with port
+		`(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?/)?` +
+		// lowercase path components
+		`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+		// optional tag and digest
+		`(?::[\w][\w.-]{0,127})?(?:@[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,})?$`)
+
+	// only the ${VAR} form is expanded, so a literal $ in a password is left as is
+	environmentVariableRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// ContainerList is the yaml file with the container images to preheat
 type ContainerList struct {
-	Containers       []string    `yaml:"containers,omitempty"`
+	Containers []Container           `yaml:"containers,omitempty" json:"containers,omitempty"`
+	Registries []RegistryCredentials `yaml:"registries,omitempty" json:"registries,omitempty"`
+	PruneKeep  []string              `yaml:"pruneKeep,omitempty" json:"pruneKeep,omitempty"`
+
+	// the maximum number of parallel pulls from a registry, for registries that throttle high parallelism
+	RegistryConcurrency map[string]int `yaml:"registryConcurrency,omitempty" json:"registryConcurrency,omitempty"`
+}
+
+// Container is a container image to preheat, defined either as a plain image string or as a mapping with options
+type Container struct {
+	Image           string `yaml:"image" json:"image"`
+	Platform        string `yaml:"platform,omitempty" json:"platform,omitempty"`
+	Digest          string `yaml:"digest,omitempty" json:"digest,omitempty"`
+	Auth            string `yaml:"auth,omitempty" json:"auth,omitempty"`
+	PullMaxRetries  *int   `yaml:"pullMaxRetries,omitempty" json:"pullMaxRetries,omitempty"`
+	IntervalSeconds int    `yaml:"intervalSeconds,omitempty" json:"intervalSeconds,omitempty"`
+
+	// containers with a higher priority are pulled before the others, for example base images
+	Priority int `yaml:"priority,omitempty" json:"priority,omitempty"`
+
+	// the heater only reports ready once all critical containers have been pulled successfully
+	Critical bool `yaml:"critical,omitempty" json:"critical,omitempty"`
+
+	// heat all tags of the repository in image, or only those fully matching the tag pattern
+	AllTags    bool   `yaml:"allTags,omitempty" json:"allTags,omitempty"`
+	TagPattern string `yaml:"tagPattern,omitempty" json:"tagPattern,omitempty"`
+
+	// heat the image for every platform in its manifest list instead of a single platform
+	AllPlatforms bool `yaml:"allPlatforms,omitempty" json:"allPlatforms,omitempty"`
+}
+
+// expandsTags returns true if the image is a repository whose tags are listed from the registry
+func (c Container) expandsTags() bool {
+	return c.AllTags || c.TagPattern != ""
+}
+
+// getTagPattern returns the expression tags have to fully match to be heated; with allTags and no tagPattern every tag
+// matches
+func (c Container) getTagPattern() *regexp.Regexp {
+	if c.TagPattern == "" {
+		return regexp.MustCompile(".*")
+	}
+
+	// the pattern is validated when reading the container list
+	return regexp.MustCompile("^(?:" + c.TagPattern + ")$")
+}
+
+// key identifies the container for scheduling, since the same image can be heated for multiple platforms
+func (c Container) key() string {
+	if c.Platform == "" {
+		return c.Image
+	}
+	return c.Image + " " + c.Platform
+}
+
+// UnmarshalYAML accepts both the plain image string and the mapping with options
+func (c *Container) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	var image string
+	if err := unmarshal(&image); err == nil {
+		*c = Container{Image: image}
+		return nil
+	}
+
+	// use an alias type to avoid recursing into this method
+	type containerAlias Container
+	var alias containerAlias
+	if err := unmarshal(&alias); err != nil {
+		return err
+	}
+	if alias.Image == "" {
+		return fmt.Errorf("Container is missing the image property")
+	}
+
+	*c = Container(alias)
+
+	return nil
+}
+
+// RegistryCredentials are used to log in to a private registry before pulling images from it
+type RegistryCredentials struct {
+	Name             string `yaml:"name,omitempty" json:"name,omitempty"`
+	Registry         string `yaml:"registry" json:"registry"`
+	Username         string `yaml:"username,omitempty" json:"username,omitempty"`
+	Password         string `yaml:"password,omitempty" json:"-"`
+	DockerConfigPath string `yaml:"dockerConfigPath,omitempty" json:"dockerConfigPath,omitempty"`
+
+	// get short-lived credentials for cloud registries from the docker-credential-<name> helper, like ecr-login
+	CredentialHelper string `yaml:"credentialHelper,omitempty" json:"credentialHelper,omitempty"`
+}
+
+// merge adds the containers, registries, images to keep and registry concurrency limits of another container list; for
+// a registry limited in both lists the lowest limit is used
+func (cl *ContainerList) merge(other ContainerList) {
+	cl.Containers = append(cl.Containers, other.Containers...)
+	cl.Registries = append(cl.Registries, other.Registries...)
+	cl.PruneKeep = append(cl.PruneKeep, other.PruneKeep...)
+	for registry, limit := range other.RegistryConcurrency {
+		if cl.RegistryConcurrency == nil {
+			cl.RegistryConcurrency = map[string]int{}
+		}
+		if current, ok := cl.RegistryConcurrency[registry]; !ok || limit < current {
+			cl.RegistryConcurrency[registry] = limit
+		}
+	}
+}
+
+// getCredentials returns the credentials referenced by the container or otherwise those for the registry its image is
+// pulled from, or nil if there are none
+func (cl *ContainerList) getCredentials(container Container) *RegistryCredentials {
+	if container.Auth != "" {
+		return cl.getCredentialsByName(container.Auth)
+	}
+
+	return cl.getCredentialsByRegistry(getImageRegistry(container.Image))
+}
+
+func (cl *ContainerList) getCredentialsByRegistry(registry string) *RegistryCredentials {
+	for i := range cl.Registries {
+		if normalizeRegistry(cl.Registries[i].Registry) == registry {
+			return &cl.Registries[i]
+		}
+	}
+
+	return nil
+}
+
+func (cl *ContainerList) getCredentialsByName(name string) *RegistryCredentials {
+	for i := range cl.Registries {
+		if cl.Registries[i].Name == name {
+			return &cl.Registries[i]
+		}
+	}
+
+	return nil
+}
+
+// validate checks the references between containers and registries
+func (cl *ContainerList) validate() error {
+	for _, c := range cl.Containers {
+		if c.Auth != "" && cl.getCredentialsByName(c.Auth) == nil {
+			return fmt.Errorf("Container %v references auth %v, which is not defined in registries", c.Image, c.Auth)
+		}
+		if c.PullMaxRetries != nil && *c.PullMaxRetries < 0 {
+			return fmt.Errorf("Container %v has a negative pullMaxRetries", c.Image)
+		}
+		if c.IntervalSeconds < 0 {
+			return fmt.Errorf("Container %v has a negative intervalSeconds", c.Image)
+		}
+		if c.AllPlatforms && c.Platform != "" {
+			return fmt.Errorf("Container %v sets both allPlatforms and platform", c.Image)
+		}
+		if c.expandsTags() {
+			if hasTagOrDigest(c.Image) {
+				return fmt.Errorf("Container %v sets allTags or tagPattern, but the image has a tag or digest", c.Image)
+			}
+			if _, err := regexp.Compile(c.TagPattern); err != nil {
+				return fmt.Errorf("Container %v has an invalid tagPattern: %v", c.Image, err)
+			}
+		}
+	}
+	for _, r := range cl.Registries {
+		if r.CredentialHelper == "" {
+			continue
+		}
+		if !credentialHelperRegex.MatchString(r.CredentialHelper) {
+			return fmt.Errorf("Registry %v has an invalid credentialHelper %v", r.Registry, r.CredentialHelper)
+		}
+		if r.Username != "" || r.Password != "" || r.DockerConfigPath != "" {
+			return fmt.Errorf("Registry %v sets credentialHelper together with other credentials", r.Registry)
+		}
+	}
+	for registry, limit := range cl.RegistryConcurrency {
+		if limit < 1 {
+			return fmt.Errorf("Registry %v has a registryConcurrency below 1", registry)
+		}
+	}
+
+	return nil
+}
+
+// removeInvalidImages removes and returns the images that aren't a valid image reference, so they don't fail the pull
+// or the entire list
+func (cl *ContainerList) removeInvalidImages() (invalidImages []string) {
+	validContainers := []Container{}
+	for _, c := range cl.Containers {
+		if !imageReferenceRegex.MatchString(c.Image) {
+			invalidImages = append(invalidImages, c.Image)
+			continue
+		}
+		validContainers = append(validContainers, c)
+	}
+	cl.Containers = validContainers
+
+	return
+}
+
+// expandEnvironmentVariables replaces ${VAR} references in the registry credentials with the value of the environment variable
+func (cl *ContainerList) expandEnvironmentVariables() error {
+	for i := range cl.Registries {
+		for _, value := range []*string{&cl.Registries[i].Username, &cl.Registries[i].Password, &cl.Registries[i].DockerConfigPath} {
+			expanded, err := expandEnvironmentVariables(*value)
+			if err != nil {
+				return fmt.Errorf("Failed expanding credentials for registry %v: %v", cl.Registries[i].Registry, err)
+			}
+			*value = expanded
+		}
+	}
+
+	return nil
+}
+
+func expandEnvironmentVariables(value string) (string, error) {
+	missing := []string{}
+	expanded := environmentVariableRegex.ReplaceAllStringFunc(value, func(reference string) string {
+		name := environmentVariableRegex.FindStringSubmatch(reference)[1]
+		envValue, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return envValue
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("Environment variable(s) %v are not set", strings.Join(missing, ", "))
+	}
+
+	return expanded, nil
+}
+
+// getImageRegistry returns the registry host of a container image, defaulting to docker hub
+func getImageRegistry(containerImage string) string {
+	parts := strings.SplitN(containerImage, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return normalizeRegistry(parts[0])
+	}
+
+	return "docker.io"
+}
+
+// getImageRepository returns the repository path of a container image within its registry, which for official docker
+// hub images is in the library namespace
+func getImageRepository(containerImage string) string {
+	repository := containerImage
+	parts := strings.SplitN(containerImage, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		repository = parts[1]
+	}
+
+	// strip the tag and digest
+	repository = strings.SplitN(repository, "@", 2)[0]
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository = repository[:i]
+	}
+
+	if getImageRegistry(containerImage) == "docker.io" && !strings.Contains(repository, "/") {
+		return "library/" + repository
+	}
+
+	return repository
+}
+
+// normalizeImage returns the fully qualified image reference, so different ways of referring to the same image can be
+// compared, like nginx and docker.io/library/nginx:latest
+func normalizeImage(containerImage string) string {
+	name := containerImage
+	suffix := ""
+	if i := strings.Index(name, "@"); i >= 0 {
+		suffix = name[i:]
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		suffix = name[i:] + suffix
+		name = name[:i]
+	}
+	if suffix == "" {
+		suffix = ":latest"
+	}
+
+	return getImageRegistry(name) + "/" + getImageRepository(name) + suffix
+}
+
+// getImageReference returns the tag or digest of a container image, defaulting to the latest tag
+func getImageReference(containerImage string) string {
+	if parts := strings.SplitN(containerImage, "@", 2); len(parts) == 2 {
+		return parts[1]
+	}
+	if i := strings.LastIndex(containerImage, ":"); i > strings.LastIndex(containerImage, "/") {
+		return containerImage[i+1:]
+	}
+
+	return "latest"
+}
+
+// hasTagOrDigest returns true if the container image references a tag or digest instead of just the repository
+func hasTagOrDigest(containerImage string) bool {
+	if strings.Contains(containerImage, "@") {
+		return true
+	}
+
+	// the registry host can contain a port, so only look for a colon after the last slash
+	return strings.LastIndex(containerImage, ":") > strings.LastIndex(containerImage, "/")
+}
+
+func normalizeRegistry(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	registry = strings.SplitN(registry, "/", 2)[0]
+
+	switch registry {
+	case "", "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+
+	return registry
+}
+
+// isInsecureRegistry returns whether the registry is one of the insecure registries, which are pulled from without tls
+// verification
+func isInsecureRegistry(insecureRegistries []string, registry string) bool {
+	for _, insecureRegistry := range insecureRegistries {
+		if normalizeRegistry(insecureRegistry) == registry {
+			return true
+		}
+	}
+	return false
 }
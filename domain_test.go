@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestExpandEnvironmentVariables(t *testing.T) {
+
+	os.Setenv("HEATER_TEST_REGISTRY_USER", "robot")
+	os.Setenv("HEATER_TEST_REGISTRY_PASS", "s3cr$t")
+	defer os.Unsetenv("HEATER_TEST_REGISTRY_USER")
+	defer os.Unsetenv("HEATER_TEST_REGISTRY_PASS")
+
+	t.Run("ExpandsBracedReferences", func(t *testing.T) {
+		for value, expected := range map[string]string{
+			"${HEATER_TEST_REGISTRY_USER}":              "robot",
+			"team-${HEATER_TEST_REGISTRY_USER}-ci":      "team-robot-ci",
+			"${HEATER_TEST_REGISTRY_PASS}":              "s3cr$t",
+			"${HEATER_TEST_REGISTRY_USER}:$HOME:$$:${}": "robot:$HOME:$$:${}",
+		} {
+			expanded, err := expandEnvironmentVariables(value)
+			if err != nil {
+				t.Fatalf("Expected no error for %v, got %v", value, err)
+			}
+			if expanded != expected {
+				t.Errorf("Expected %v for %v, got %v", expected, value, expanded)
+			}
+		}
+	})
+
+	t.Run("KeepsLiteralDollarSigns", func(t *testing.T) {
+		for _, value := range []string{"s3cr$t", "pa$$word", "a$!b", "$", "trailing$", "${not-a-name}"} {
+			expanded, err := expandEnvironmentVariables(value)
+			if err != nil {
+				t.Fatalf("Expected no error for %v, got %v", value, err)
+			}
+			if expanded != value {
+				t.Errorf("Expected %v to be left as is, got %v", value, expanded)
+			}
+		}
+	})
+
+	t.Run("ReturnsErrorForUnsetVariables", func(t *testing.T) {
+		_, err := expandEnvironmentVariables("${HEATER_TEST_UNSET_USER}:${HEATER_TEST_UNSET_PASS}")
+
+		expected := "Environment variable(s) HEATER_TEST_UNSET_USER, HEATER_TEST_UNSET_PASS are not set"
+		if err == nil || err.Error() != expected {
+			t.Errorf("Expected error %q, got %v", expected, err)
+		}
+	})
+}
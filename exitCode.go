@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// the exit codes for the failures automation around the heater may want to react to differently; other failures exit
+// with 1 like log.Fatal does
+const (
+	exitCodeFailed                = 1
+	exitCodeDaemonStartFailed     = 2
+	exitCodeRegistryHealthTimeout = 3
+	exitCodeConfigInvalid         = 4
+	exitCodeAllPullsFailed        = 5
+)
+
+// exit logs the failure and exits with the exit code
+func exit(exitCode int, err error, format string, v ...interface{}) {
+	log.Error().Err(err).Int("exitCode", exitCode).Msgf(format, v...)
+	os.Exit(exitCode)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// healthChecker reports liveness once the docker daemon runs and readiness once the cache has been heated
+type healthChecker struct {
+	dockerRunner DockerRunner
+	ready        int32
+	failedPulls  int32
+
+	// the number of critical images that haven't been pulled successfully yet
+	pendingCriticalImages int32
+}
+
+func newHealthChecker(dockerRunner DockerRunner) *healthChecker {
+	return &healthChecker{
+		dockerRunner: dockerRunner,
+	}
+}
+
+func (hc *healthChecker) setReady() {
+	atomic.StoreInt32(&hc.ready, 1)
+}
+
+func (hc *healthChecker) setFailedPulls(failedPulls int) {
+	atomic.StoreInt32(&hc.failedPulls, int32(failedPulls))
+}
+
+func (hc *healthChecker) setPendingCriticalImages(pendingCriticalImages int) {
+	atomic.StoreInt32(&hc.pendingCriticalImages, int32(pendingCriticalImages))
+}
+
+func (hc *healthChecker) isReady() bool {
+	return atomic.LoadInt32(&hc.ready) == 1
+}
+
+func (hc *healthChecker) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	if !hc.dockerRunner.isDockerDaemonReady(r.Context()) {
+		http.Error(w, "Docker daemon is not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("I'm alive!"))
+}
+
+func (hc *healthChecker) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	failedPulls := atomic.LoadInt32(&hc.failedPulls)
+
+	if !hc.isReady() {
+		if pendingCriticalImages := atomic.LoadInt32(&hc.pendingCriticalImages); pendingCriticalImages > 0 {
+			http.Error(w, fmt.Sprintf("%v critical image(s) haven't been pulled successfully yet", pendingCriticalImages), http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, fmt.Sprintf("No heating cycle has completed successfully yet, %v image(s) failed to pull in the last cycle; see /config for the last error of each image", failedPulls), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintf(w, "I'm ready! %v image(s) failed to pull in the last cycle", failedPulls)
+}
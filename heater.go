@@ -0,0 +1,1374 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+// heaterConfig holds the settings for the heating cycles
+type heaterConfig struct {
+	containerListFilePath            string
+	containerListFetchTimeoutSeconds int
+	containerListRetrySeconds        int
+	valuesFile                       string
+	heatIntervalSeconds              int
+	maxConcurrentPulls               int
+	defaultPlatform                  string
+	disablePrune                     bool
+	pruneDanglingOnly                bool
+	pruneKeep                        []string
+	pruneKeepPulled                  bool
+	pruneDiskThresholdPercent        float64
+	insecureRegistries               []string
+	discoveryRegistry                string
+	discoveryTagsPerRepo             int
+	discoveryRepoFilter              string
+	discoveryMaxImageAgeDays         int
+	dryRun                           bool
+	requireNonEmptyList              bool
+	maxCacheBytes                    int64
+	// regular expressions the images have to match any of, and must not match any of, to be heated
+	imageInclude []string
+	imageExclude []string
+	// spread the pulls evenly over the heat interval instead of starting them all at once
+	staggerPulls bool
+	// pull one image at a time instead of in parallel
+	sequential bool
+	// instead of pruning everything, only keep this many of the most recently pulled tags of each repository
+	keepTagsPerRepo int
+	// namespaces to heat the images used by pods and deployments of
+	kubernetesNamespaces []string
+	// how long to skip the images of a registry after it rate limited a pull
+	rateLimitCooldown time.Duration
+	// instead of pruning everything, remove the images that aren't in the container list, keeping one copy of images
+	// pulled under several tags
+	pruneByDigest bool
+	// when the heater started, to measure how long it takes for the cache to become warm
+	startedAt time.Time
+	// a directory with tarballs created with docker save to load images from when pulling them fails
+	imageTarballDir string
+	// the directory of the docker daemon's images, to measure the disk usage of
+	dockerDataRoot string
+	// the maximum number of parallel pulls per registry, overridden by the limits in the container list
+	registryConcurrency map[string]int
+	// the maximum number of intervals to back off the pulls of an image that keeps failing, 1 retries it every interval
+	failureBackoffMaxIntervals int
+	// a docker config.json with the credentials for registries the container list has no credentials for
+	dockerConfigPath string
+	// the minimum number of seconds between a prune and the next heating cycle
+	postPruneCooldownSeconds int
+	// only prune in one of this many heating cycles
+	pruneEveryNCycles int
+	// skip the prune when more than the ratio of the pulls in a cycle failed
+	skipPruneOnFailure    bool
+	skipPruneFailureRatio float64
+}
+
+// heater runs the heating cycles that pull all images in the container list to warm the cache
+type heater struct {
+	heaterConfig
+
+	dockerRunner        DockerRunner
+	healthChecker       *healthChecker
+	status              *heaterStatus
+	containerListClient *http.Client
+	registryClient      *registryClient
+	kubernetesClient    *kubernetesClient
+	pullSchedule        *pullSchedule
+	imageCache          *imageCache
+	registryCooldowns   *registryCooldowns
+	credentialHelpers   *credentialHelpers
+	jitter              *jitter
+
+	// images that were removed from the container list since the last prune, to remove when evicting by cache size
+	staleImages []cachedImage
+
+	// the last container list fetched successfully from a url, to fall back to when fetching fails
+	lastKnownGoodContainerList *ContainerList
+	// whether the container list couldn't be read in the last cycle, to try again sooner
+	containerListFailed bool
+	// the next heating cycle doesn't start before this time after a prune
+	pruneCooldownUntil time.Time
+	// the number of heating cycles that reached the prune, to prune every n cycles
+	pruneCycles int
+
+	// the containers pulled successfully at least once, to tell when all critical containers have been heated
+	pulledContainers map[string]bool
+	// whether all containers have been pulled successfully in a cycle without failures
+	warm bool
+
+	// the number of images pulled at the same time, ramping up to maxConcurrentPulls
+	concurrentPulls int
+	// limits the parallel pulls of the heating cycles and the pulls on request together
+	pullSlots *pullSlots
+
+	// makes parallel pulls failing on a full disk share a single emergency prune
+	emergencyPruneMutex sync.Mutex
+	lastEmergencyPrune  time.Time
+}
+
+func newHeater(dockerRunner DockerRunner, healthChecker *healthChecker, status *heaterStatus, jitter *jitter, config heaterConfig) *heater {
+	return &heater{
+		heaterConfig:  config,
+		dockerRunner:  dockerRunner,
+		healthChecker: healthChecker,
+		status:        status,
+		containerListClient: &http.Client{
+			Timeout: time.Duration(config.containerListFetchTimeoutSeconds) * time.Second,
+		},
+		registryClient:    newRegistryClient(config.insecureRegistries),
+		kubernetesClient:  newKubernetesClient(),
+		pullSchedule:      newPullSchedule(jitter),
+		imageCache:        newImageCache(),
+		registryCooldowns: newRegistryCooldowns(config.rateLimitCooldown),
+		credentialHelpers: newCredentialHelpers(),
+		jitter:            jitter,
+
+		concurrentPulls:  config.maxConcurrentPulls,
+		pullSlots:        newPullSlots(getPullLimit(config.maxConcurrentPulls, config.sequential), config.registryConcurrency),
+		pulledContainers: map[string]bool{},
+	}
+}
+
+// setConcurrentPulls sets the number of images pulled at the same time from the next heating cycle on
+func (h *heater) setConcurrentPulls(concurrentPulls int) {
+	log.Info().Msgf("Pulling up to %v images at the same time", concurrentPulls)
+	h.concurrentPulls = concurrentPulls
+}
+
+// getPullLimit returns the number of images pulled at the same time, which is one when pulling sequentially
+func getPullLimit(concurrentPulls int, sequential bool) int {
+	if sequential {
+		return 1
+	}
+	return concurrentPulls
+}
+
+// cycleResult holds the outcome of a single heating cycle
+type cycleResult struct {
+	images          int
+	pulledImages    []string
+	pulledKeys      []string
+	failedPulls     []pullFailure
+	downloadedBytes int64
+	pulledBytes     int64
+	pruned          bool
+}
+
+// logSummary logs a single line with the outcome of the heating cycle
+func (r cycleResult) logSummary(duration time.Duration) {
+	log.Info().
+		Int("attempted", r.images).
+		Int("succeeded", len(r.pulledImages)).
+		Int("failed", len(r.failedPulls)).
+		Int("untrusted", len(r.untrustedImages())).
+		Int("rateLimited", len(r.rateLimitedImages())).
+		Int64("downloadedBytes", r.downloadedBytes).
+		Int64("pulledBytes", r.pulledBytes).
+		Float64("durationSeconds", duration.Seconds()).
+		Bool("pruned", r.pruned).
+		Msgf("Finished heating cycle in %v", duration.Round(time.Second))
+}
+
+// untrustedImages returns the images that failed content trust verification
+func (r cycleResult) untrustedImages() (images []string) {
+	for _, f := range r.failedPulls {
+		if _, ok := f.err.(untrustedImageError); ok {
+			images = append(images, f.image)
+		}
+	}
+	return
+}
+
+// rateLimitedImages returns the images that were rate limited by their registry or skipped because of it
+func (r cycleResult) rateLimitedImages() (images []string) {
+	for _, f := range r.failedPulls {
+		if _, ok := f.err.(rateLimitedError); ok {
+			images = append(images, f.image)
+		}
+	}
+	return
+}
+
+// pullFailure is an image that failed to pull in a heating cycle
+type pullFailure struct {
+	image string
+	err   error
+}
+
+// runCycle pulls all images in the container list and prunes everything else; cancelling the context aborts the
+// in-flight pulls and skips the remainder of the cycle
+func (h *heater) runCycle(ctx context.Context) (result cycleResult, err error) {
+
+	containerList, err := h.readContainerList(ctx)
+	h.containerListFailed = err != nil
+	if err != nil {
+		return
+	}
+
+	// replace repositories with all their (matching) tags
+	containers, tagFailures := h.expandTags(ctx, containerList)
+
+	// replace images with the image for each platform in their manifest list
+	containers, platformFailures := h.expandPlatforms(ctx, containerList, containers)
+	tagFailures = append(tagFailures, platformFailures...)
+
+	// add the most recent images in the discovery registry
+	if h.discoveryRegistry != "" {
+		discoveredContainers, discoveryFailures := h.discoverContainers(ctx, containerList)
+		containers = append(containers, discoveredContainers...)
+		tagFailures = append(tagFailures, discoveryFailures...)
+	}
+
+	// add the images in use in the kubernetes namespaces
+	if len(h.kubernetesNamespaces) > 0 {
+		discoveredContainers, discoveryFailures := h.discoverKubernetesContainers(ctx)
+		containers = append(containers, discoveredContainers...)
+		tagFailures = append(tagFailures, discoveryFailures...)
+	}
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	result.failedPulls = tagFailures
+
+	containers = h.dedupeContainers(containers)
+	containers = h.filterContainers(containers)
+
+	containerListImages.Set(float64(len(containers)))
+
+	// only pull the containers whose interval has elapsed
+	dueContainers := h.getDueContainers(containers)
+	result.images = len(dueContainers) + len(tagFailures)
+	if len(dueContainers) == 0 {
+		if len(tagFailures) > 0 {
+			h.reportFailedPulls(result)
+			h.status.setCycleResult(result)
+		}
+		// an empty container list, or one without images due, doesn't keep the heater from becoming ready
+		h.updateReadiness(containers, result)
+		return
+	}
+
+	var staggerDelay time.Duration
+	if h.staggerPulls {
+		staggerDelay = time.Duration(h.heatIntervalSeconds) * time.Second / time.Duration(len(dueContainers))
+		log.Info().Msgf("Staggering the pulls of %v images by %v", len(dueContainers), staggerDelay.Round(time.Second))
+	}
+
+	// pull images with a higher priority first, so the images sharing their layers can reuse them
+	priorityGroups := groupByPriority(dueContainers)
+	startedPulls := 0
+	for _, priorityContainers := range priorityGroups {
+		if len(priorityGroups) > 1 {
+			log.Info().Msgf("Pulling %v images with priority %v...", len(priorityContainers), priorityContainers[0].Priority)
+		}
+		h.pullContainers(ctx, priorityContainers, containerList, staggerDelay, startedPulls, &result)
+		startedPulls += len(priorityContainers)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+
+	h.reportFailedPulls(result)
+	h.status.setCycleResult(result)
+
+	h.updateReadiness(containers, result)
+	h.updateWarm(containers, result)
+
+	if h.skipPrune(result) {
+		return
+	}
+
+	result.pruned = h.prune(ctx, containerList, containers, result.pulledImages)
+	if result.pruned && h.postPruneCooldownSeconds > 0 {
+		cooldown := time.Duration(h.jitter.apply(h.postPruneCooldownSeconds)) * time.Second
+		h.pruneCooldownUntil = time.Now().Add(cooldown)
+		log.Info().Msgf("Waiting at least %v seconds after the prune before pulling again", int(cooldown.Seconds()))
+	}
+
+	return
+}
+
+// expandTags replaces containers with allTags or a tagPattern by a container for each matching tag in the registry;
+// repositories whose tags can't be listed are returned as failures
+func (h *heater) expandTags(ctx context.Context, containerList ContainerList) (containers []Container, failures []pullFailure) {
+
+	for _, c := range containerList.Containers {
+		if !c.expandsTags() {
+			containers = append(containers, c)
+			continue
+		}
+
+		tags, err := h.registryClient.listTags(ctx, getImageRegistry(c.Image), getImageRepository(c.Image), h.getCredentials(containerList, c))
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed listing tags of repository '%v'", c.Image)
+			failures = append(failures, pullFailure{image: c.Image, err: err})
+			continue
+		}
+
+		tagPattern := c.getTagPattern()
+
+		matchingTags := 0
+		for _, tag := range tags {
+			if !tagPattern.MatchString(tag) {
+				continue
+			}
+			tagContainer := c
+			tagContainer.Image = c.Image + ":" + tag
+			tagContainer.AllTags = false
+			tagContainer.TagPattern = ""
+			containers = append(containers, tagContainer)
+			matchingTags++
+		}
+
+		log.Info().Msgf("Repository '%v' has %v of %v tags to heat", c.Image, matchingTags, len(tags))
+	}
+
+	return
+}
+
+// expandPlatforms replaces containers with allPlatforms by a container for each platform in the image's manifest list, so
+// each platform is pulled, and fails or succeeds, on its own; images that fail to be inspected are returned as failures
+func (h *heater) expandPlatforms(ctx context.Context, containerList ContainerList, containers []Container) (expandedContainers []Container, failures []pullFailure) {
+
+	for _, c := range containers {
+		if !c.AllPlatforms {
+			expandedContainers = append(expandedContainers, c)
+			continue
+		}
+
+		platforms, err := h.registryClient.listPlatforms(ctx, getImageRegistry(c.Image), getImageRepository(c.Image), getImageReference(c.Image), h.getCredentials(containerList, c))
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed listing platforms of image '%v'", c.Image)
+			failures = append(failures, pullFailure{image: c.Image, err: err})
+			continue
+		}
+
+		// an image for a single platform is pulled as usual
+		if len(platforms) == 0 {
+			log.Debug().Msgf("Image '%v' has no manifest list, pulling it for a single platform", c.Image)
+			c.AllPlatforms = false
+			expandedContainers = append(expandedContainers, c)
+			continue
+		}
+
+		log.Info().Strs("platforms", platforms).Msgf("Image '%v' has %v platforms to heat", c.Image, len(platforms))
+		for _, platform := range platforms {
+			platformContainer := c
+			platformContainer.Platform = platform
+			platformContainer.AllPlatforms = false
+			expandedContainers = append(expandedContainers, platformContainer)
+		}
+	}
+
+	return
+}
+
+// dedupeContainers removes containers referring to the same image and platform as an earlier container, to avoid
+// pulling it more than once
+func (h *heater) dedupeContainers(containers []Container) (dedupedContainers []Container) {
+
+	seen := map[string]int{}
+	for _, c := range containers {
+		platform := c.Platform
+		if platform == "" {
+			platform = h.defaultPlatform
+		}
+
+		key := normalizeImage(c.Image) + " " + platform
+		if i, ok := seen[key]; ok {
+			// the image stays critical if any of its duplicates is
+			dedupedContainers[i].Critical = dedupedContainers[i].Critical || c.Critical
+			continue
+		}
+		seen[key] = len(dedupedContainers)
+		dedupedContainers = append(dedupedContainers, c)
+	}
+
+	if duplicates := len(containers) - len(dedupedContainers); duplicates > 0 {
+		log.Info().Msgf("Collapsed %v duplicate images in the container list", duplicates)
+	}
+
+	return
+}
+
+// updateReadiness marks the heater ready once all critical containers have been pulled successfully at least once,
+// regardless of failing best-effort containers; without critical containers the cache is warm once all images have
+// been pulled successfully in a single cycle
+func (h *heater) updateReadiness(containers []Container, result cycleResult) {
+
+	for _, key := range result.pulledKeys {
+		h.pulledContainers[key] = true
+	}
+
+	criticalContainers := 0
+	pendingCriticalContainers := 0
+	for _, c := range containers {
+		if !c.Critical {
+			continue
+		}
+		criticalContainers++
+		if !h.pulledContainers[c.key()] {
+			pendingCriticalContainers++
+		}
+	}
+	h.healthChecker.setPendingCriticalImages(pendingCriticalContainers)
+
+	if criticalContainers == 0 && len(result.failedPulls) > 0 {
+		return
+	}
+	if pendingCriticalContainers > 0 {
+		log.Info().Msgf("%v of %v critical images haven't been pulled successfully yet", pendingCriticalContainers, criticalContainers)
+		return
+	}
+
+	h.healthChecker.setReady()
+}
+
+// updateWarm reports the time since the heater started once a cycle completes without failures and every container in
+// the list has been pulled successfully, to tell how long it takes for a cold node to get a warm cache
+func (h *heater) updateWarm(containers []Container, result cycleResult) {
+
+	if h.warm || len(result.failedPulls) > 0 {
+		return
+	}
+	for _, c := range containers {
+		if !h.pulledContainers[c.key()] {
+			return
+		}
+	}
+
+	h.warm = true
+	timeToWarm := time.Since(h.startedAt)
+	observeTimeToWarm(timeToWarm)
+
+	log.Info().Float64("timeToWarmSeconds", timeToWarm.Seconds()).Msgf("Cache warm after %v", timeToWarm.Round(time.Second))
+}
+
+// filterContainers keeps the containers whose image matches any of the include expressions, if set, and none of the
+// exclude expressions, so a shared container list can be narrowed down for each deployment
+func (h *heater) filterContainers(containers []Container) (filteredContainers []Container) {
+
+	if len(h.imageInclude) == 0 && len(h.imageExclude) == 0 {
+		return containers
+	}
+
+	includes := make([]*regexp.Regexp, len(h.imageInclude))
+	for i, include := range h.imageInclude {
+		includes[i] = regexp.MustCompile(include)
+	}
+	excludes := make([]*regexp.Regexp, len(h.imageExclude))
+	for i, exclude := range h.imageExclude {
+		excludes[i] = regexp.MustCompile(exclude)
+	}
+
+	for _, c := range containers {
+		if len(includes) > 0 && !matchesAny(includes, c.Image) {
+			continue
+		}
+		if matchesAny(excludes, c.Image) {
+			continue
+		}
+		filteredContainers = append(filteredContainers, c)
+	}
+
+	log.Info().
+		Int("included", len(filteredContainers)).
+		Int("filtered", len(containers)-len(filteredContainers)).
+		Msgf("Included %v of %v images in the container list", len(filteredContainers), len(containers))
+
+	return
+}
+
+func matchesAny(expressions []*regexp.Regexp, s string) bool {
+	for _, expression := range expressions {
+		if expression.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// pullContainers pulls the containers in parallel, or one by one if sequential, and adds the outcome to the result; with
+// a stagger delay each pull starts that long after the previous one, including the last one of the previous priority
+// group when startedPulls is non-zero, so the registry sees a steady load
+func (h *heater) pullContainers(ctx context.Context, containers []Container, containerList ContainerList, staggerDelay time.Duration, startedPulls int, result *cycleResult) {
+
+	// pulls a single container and adds its outcome to the result
+	var resultMutex sync.Mutex
+	pull := func(container Container, credentials *RegistryCredentials) {
+		// don't pull from a registry that's rate limiting pulls, that only extends the limit
+		registry := getImageRegistry(container.Image)
+		if until, ok := h.registryCooldowns.get(registry, time.Now()); ok {
+			h.pullSchedule.postpone(container.key(), until)
+
+			err := rateLimitedError{registry: registry, until: until}
+			h.status.setPullResult(container, err)
+
+			resultMutex.Lock()
+			defer resultMutex.Unlock()
+			result.failedPulls = append(result.failedPulls, pullFailure{image: container.Image, err: err})
+			return
+		}
+
+		start := time.Now()
+		h.pullSchedule.schedule(container.key(), h.getIntervalSeconds(container), start)
+
+		downloadedBytes, err := h.dockerRunner.runDockerPull(ctx, container, credentials)
+		if isNoSpaceLeftError(err) && ctx.Err() == nil {
+			resultMutex.Lock()
+			pulledImages := append([]string{}, result.pulledImages...)
+			resultMutex.Unlock()
+
+			// free up space and try once more, instead of failing all remaining pulls until the prune at the end
+			if h.emergencyPrune(ctx, containerList, pulledImages, start) {
+				log.Info().Msgf("Retrying pull of docker image '%v' after emergency prune", container.Image)
+				downloadedBytes, err = h.dockerRunner.runDockerPull(ctx, container, credentials)
+			}
+		}
+		err = h.handleRateLimitedPull(registry, err)
+		if rateLimited, ok := err.(rateLimitedError); ok {
+			h.pullSchedule.postpone(container.key(), rateLimited.until)
+		}
+
+		// keep the cache warm from a pre-staged tarball while the registry is unreachable
+		loadedFromTarball := false
+		if err != nil && ctx.Err() == nil && h.imageTarballDir != "" {
+			if h.loadImageTarball(ctx, container, err) {
+				err = nil
+				loadedFromTarball = true
+			}
+		}
+		observePull(container, time.Since(start), downloadedBytes, err)
+		// an image loaded from a tarball has no digest from the registry to verify
+		if err == nil && container.Digest != "" && !loadedFromTarball && !h.dryRun {
+			h.verifyDigest(ctx, container)
+		}
+		var sizeBytes int64
+		if err == nil && !h.dryRun {
+			sizeBytes = h.measureImage(ctx, container)
+		}
+
+		consecutiveFailures := h.status.setPullResult(container, err)
+
+		// retry images that keep failing less often, rate limited images are already postponed for the registry
+		if _, rateLimited := err.(rateLimitedError); err != nil && !rateLimited && h.failureBackoffMaxIntervals > 1 {
+			if intervals := getBackoffIntervals(consecutiveFailures, h.failureBackoffMaxIntervals); intervals > 1 {
+				until := start.Add(time.Duration(intervals*h.getIntervalSeconds(container)) * time.Second)
+				h.pullSchedule.postpone(container.key(), until)
+				h.status.setBackoff(container, intervals, until)
+				log.Info().Msgf("Backing off pulls of docker image '%v' for %v intervals after %v consecutive failures", container.Image, intervals, consecutiveFailures)
+			}
+		}
+
+		resultMutex.Lock()
+		defer resultMutex.Unlock()
+		if err != nil {
+			result.failedPulls = append(result.failedPulls, pullFailure{image: container.Image, err: err})
+			return
+		}
+		result.pulledImages = append(result.pulledImages, container.Image)
+		result.pulledKeys = append(result.pulledKeys, container.key())
+		result.downloadedBytes += downloadedBytes
+		result.pulledBytes += sizeBytes
+	}
+
+	var wg sync.WaitGroup
+
+	// limit the number of parallel pulls to avoid saturating disk and network, and limit them further for registries
+	// that throttle high parallelism
+	h.pullSlots.setLimits(getPullLimit(h.concurrentPulls, h.sequential), h.getRegistryConcurrency(containerList))
+
+	for i, c := range containers {
+		if startedPulls+i > 0 && staggerDelay > 0 {
+			select {
+			case <-time.After(staggerDelay):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		// pull one image at a time in the order of the list, for nodes where any parallelism causes thrashing; the single
+		// slot is shared with the pulls on request
+		if h.sequential {
+			release, ok := h.pullSlots.acquire(ctx, getImageRegistry(c.Image))
+			if !ok {
+				break
+			}
+			pull(c, h.getCredentials(containerList, c))
+			release()
+			continue
+		}
+
+		// pull all images in parallel
+		wg.Add(1)
+		go func(container Container, credentials *RegistryCredentials) {
+			defer wg.Done()
+			release, ok := h.pullSlots.acquire(ctx, getImageRegistry(container.Image))
+			if !ok {
+				return
+			}
+			defer release()
+
+			pull(container, credentials)
+		}(c, h.getCredentials(containerList, c))
+	}
+	// wait for all pulls to finish
+	wg.Wait()
+}
+
+// pullImage pulls a single container outside the heating cycles, with the credentials in the current container list; it
+// waits for a pull slot like the pulls of the cycles, and doesn't pull from a registry that's rate limiting pulls
+func (h *heater) pullImage(ctx context.Context, container Container) (downloadedBytes int64, err error) {
+
+	registry := getImageRegistry(container.Image)
+	if until, ok := h.registryCooldowns.get(registry, time.Now()); ok {
+		return 0, rateLimitedError{registry: registry, until: until}
+	}
+
+	release, ok := h.pullSlots.acquire(ctx, registry)
+	if !ok {
+		return 0, ctx.Err()
+	}
+	defer release()
+
+	containerList := h.status.getContainerList()
+
+	start := time.Now()
+	downloadedBytes, err = h.dockerRunner.runDockerPull(ctx, container, h.getCredentials(containerList, container))
+	err = h.handleRateLimitedPull(registry, err)
+	observePull(container, time.Since(start), downloadedBytes, err)
+	h.status.setPullResult(container, err)
+	if err == nil && !h.dryRun {
+		h.measureImage(ctx, container)
+	}
+
+	return
+}
+
+// handleRateLimitedPull skips the images of the registry for the cooldown after it rate limited a pull and returns the
+// error to report for the pull; without a cooldown a rate limited pull is a failed pull like any other
+func (h *heater) handleRateLimitedPull(registry string, err error) error {
+	if !isRateLimitedError(err) {
+		return err
+	}
+
+	observeRateLimitedPull(registry)
+	if h.registryCooldowns.cooldown <= 0 {
+		return err
+	}
+
+	until := h.registryCooldowns.start(registry, time.Now())
+	return rateLimitedError{registry: registry, until: until, err: err}
+}
+
+// groupByPriority splits the containers into groups of equal priority, ordered from the highest priority to the lowest
+func groupByPriority(containers []Container) (groups [][]Container) {
+
+	sorted := append([]Container{}, containers...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+
+	for i, c := range sorted {
+		if i == 0 || c.Priority != sorted[i-1].Priority {
+			groups = append(groups, []Container{})
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], c)
+	}
+
+	return
+}
+
+// getDueContainers returns the containers that are due to be pulled, with defaults applied
+func (h *heater) getDueContainers(containers []Container) (dueContainers []Container) {
+
+	now := time.Now()
+	keys := map[string]bool{}
+	for _, c := range containers {
+		if c.Platform == "" {
+			c.Platform = h.defaultPlatform
+		}
+
+		keys[c.key()] = true
+		if h.pullSchedule.isDue(c.key(), now) {
+			dueContainers = append(dueContainers, c)
+		}
+	}
+
+	h.pullSchedule.retain(keys)
+	h.staleImages = append(h.staleImages, h.imageCache.retain(keys)...)
+	h.status.retainImages(keys)
+	cachedImagesBytes.Set(float64(h.imageCache.totalBytes()))
+
+	log.Info().Msgf("%v of %v images are due to be pulled", len(dueContainers), len(containers))
+
+	return
+}
+
+func (h *heater) getIntervalSeconds(container Container) int {
+	if container.IntervalSeconds > 0 {
+		return container.IntervalSeconds
+	}
+	return h.heatIntervalSeconds
+}
+
+// getCredentials returns the credentials for the container from the container list, falling back to the docker config
+// for registries the list has no credentials for
+func (h *heater) getCredentials(containerList ContainerList, container Container) *RegistryCredentials {
+	if container.Auth != "" {
+		return h.credentialHelpers.resolve(containerList.getCredentials(container))
+	}
+
+	return h.getCredentialsByRegistry(containerList, getImageRegistry(container.Image))
+}
+
+func (h *heater) getCredentialsByRegistry(containerList ContainerList, registry string) *RegistryCredentials {
+	if credentials := containerList.getCredentialsByRegistry(registry); credentials != nil || h.dockerConfigPath == "" {
+		return h.credentialHelpers.resolve(credentials)
+	}
+
+	// the file is read for each image, so updates to a mounted secret are picked up
+	config, err := readDockerConfig(h.dockerConfigPath)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed reading credentials for registry %v", registry)
+		return nil
+	}
+	if !config.hasAuth(registry) {
+		return nil
+	}
+
+	return &RegistryCredentials{
+		Registry:         registry,
+		DockerConfigPath: h.dockerConfigPath,
+	}
+}
+
+// nextCycleIn returns how long to wait until the next container is due, or the heat interval with jitter applied if
+// nothing is scheduled
+func (h *heater) nextCycleIn() (nextCycleIn time.Duration) {
+	nextDue, ok := h.pullSchedule.nextDue()
+	if !ok {
+		nextCycleIn = time.Duration(h.jitter.apply(h.heatIntervalSeconds)) * time.Second
+	} else if nextCycleIn = time.Until(nextDue); nextCycleIn < 0 {
+		nextCycleIn = 0
+	}
+
+	// try again soon when the container list couldn't be read, for example because its config map isn't mounted yet
+	if h.containerListFailed && h.containerListRetrySeconds > 0 {
+		retryIn := time.Duration(h.jitter.apply(h.containerListRetrySeconds)) * time.Second
+		if retryIn < nextCycleIn {
+			nextCycleIn = retryIn
+		}
+	}
+
+	// don't pull again right after a prune, since the next cycle pulls everything the prune removed
+	if cooldownIn := time.Until(h.pruneCooldownUntil); cooldownIn > nextCycleIn {
+		return cooldownIn
+	}
+
+	return nextCycleIn
+}
+
+// measureImage logs the size of the pulled image and updates the total size of all images
+func (h *heater) measureImage(ctx context.Context, container Container) int64 {
+
+	sizeBytes, err := h.dockerRunner.getImageSize(ctx, container.Image)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed inspecting size of image '%v'", container.Image)
+		return 0
+	}
+
+	log.Info().Int64("sizeBytes", sizeBytes).Msgf("Image '%v' is %.1f MB", container.Image, float64(sizeBytes)/1024/1024)
+
+	h.imageCache.set(container.key(), container.Image, sizeBytes)
+	cachedImagesBytes.Set(float64(h.imageCache.totalBytes()))
+
+	return sizeBytes
+}
+
+// loadImageTarball loads the container's image from its tarball in the image tarball dir after its pull failed, and
+// returns whether it did
+func (h *heater) loadImageTarball(ctx context.Context, container Container, pullErr error) bool {
+
+	tarballPath := filepath.Join(h.imageTarballDir, getImageTarballName(container.Image))
+	if _, err := os.Stat(tarballPath); err != nil {
+		log.Debug().Err(err).Msgf("No tarball to load image '%v' from", container.Image)
+		return false
+	}
+
+	log.Warn().Err(pullErr).Msgf("Failed pulling docker image '%v', loading it from %v instead", container.Image, tarballPath)
+
+	err := h.dockerRunner.runDockerLoad(ctx, container.Image, tarballPath)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed loading docker image '%v' from %v", container.Image, tarballPath)
+		return false
+	}
+
+	return true
+}
+
+// getImageTarballName returns the file name of the tarball of an image, the image as in the container list with
+// slashes and colons replaced by underscores, like estafette_ci-builder_latest.tar
+func getImageTarballName(containerImage string) string {
+	return strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(containerImage) + ".tar"
+}
+
+// verifyDigest warns when the pulled image doesn't match the digest it's pinned to
+func (h *heater) verifyDigest(ctx context.Context, container Container) {
+
+	digests, err := h.dockerRunner.getImageDigests(ctx, container.Image)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed inspecting digest of image '%v'", container.Image)
+		return
+	}
+
+	for _, digest := range digests {
+		if digest == container.Digest {
+			return
+		}
+	}
+
+	log.Warn().Strs("digests", digests).Msgf("Image '%v' doesn't match pinned digest %v", container.Image, container.Digest)
+}
+
+func (h *heater) reportFailedPulls(result cycleResult) {
+
+	failedPulls.Set(float64(len(result.failedPulls)))
+	h.healthChecker.setFailedPulls(len(result.failedPulls))
+
+	if len(result.failedPulls) == 0 {
+		log.Info().Msgf("All %v images pulled successfully", result.images)
+		return
+	}
+
+	failedImages := make([]string, len(result.failedPulls))
+	for i, f := range result.failedPulls {
+		failedImages[i] = f.image
+		log.Debug().Err(f.err).Msgf("Image '%v' failed to pull", f.image)
+	}
+
+	log.Warn().Strs("failedImages", failedImages).Msgf("%v of %v images failed to pull", len(result.failedPulls), result.images)
+
+	// unsigned images are a supply chain problem rather than a registry or network issue, so call them out
+	if untrustedImages := result.untrustedImages(); len(untrustedImages) > 0 {
+		log.Error().Strs("untrustedImages", untrustedImages).Msgf("%v images failed content trust verification", len(untrustedImages))
+	}
+
+	if rateLimitedImages := result.rateLimitedImages(); len(rateLimitedImages) > 0 {
+		log.Warn().Strs("rateLimitedImages", rateLimitedImages).Msgf("%v images were rate limited by their registry", len(rateLimitedImages))
+	}
+}
+
+// prune removes unused containers, images, etc and returns whether it ran
+func (h *heater) prune(ctx context.Context, containerList ContainerList, containers []Container, pulledImages []string) bool {
+
+	if h.disablePrune {
+		log.Info().Msg("Pruning is disabled")
+		return false
+	}
+
+	// remove individual images to stay below the maximum cache size or number of tags instead of pruning everything
+	if h.maxCacheBytes > 0 || h.keepTagsPerRepo > 0 {
+		return h.evictImages(ctx)
+	}
+
+	// only prune every n cycles, starting with the first one, to keep more warm layers when the images hardly change
+	cycle := h.pruneCycles
+	h.pruneCycles++
+	if cycle%h.pruneEveryNCycles != 0 {
+		log.Info().Msgf("Skipping prune, pruning every %v cycles", h.pruneEveryNCycles)
+		return false
+	}
+
+	diskUsagePercent, err := getDiskUsagePercent(h.dockerDataRoot)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed measuring disk usage of %v", h.dockerDataRoot)
+	} else {
+		log.Info().Msgf("Disk usage of %v is %.1f%%", h.dockerDataRoot, diskUsagePercent)
+
+		// only prune when the disk is getting full, to keep as much of the cache as possible
+		if diskUsagePercent < h.pruneDiskThresholdPercent {
+			log.Info().Msgf("Skipping prune, disk usage is below the threshold of %v%%", h.pruneDiskThresholdPercent)
+			return false
+		}
+	}
+
+	// only remove the images that aren't in the container list, so they don't have to be downloaded again
+	if h.pruneByDigest {
+		// the images to remove are listed from the docker daemon, which isn't started in a dry run
+		if h.dryRun {
+			log.Info().Strs("keepImages", h.getKeepImages(containerList, pulledImages)).Msgf("Dry run: removing the images not in the container list of %v images", len(containers))
+			return true
+		}
+		err = h.pruneImagesByDigest(ctx, containers, h.getKeepImages(containerList, pulledImages))
+		observePrune(err)
+		return err == nil
+	}
+
+	// only remove untagged images, keeping everything pulled before
+	if h.pruneDanglingOnly {
+		err = h.dockerRunner.runDockerImagePrune(ctx)
+		observePrune(err)
+		return err == nil
+	}
+
+	// prune all containers, images, volumes, etc, except for the images to keep
+	err = h.dockerRunner.runDockerSystemPrune(ctx, h.getKeepImages(containerList, pulledImages))
+	observePrune(err)
+
+	return err == nil
+}
+
+// skipPrune returns true when too many pulls failed to prune, since the prune could remove images from earlier cycles
+// that can't be pulled again right now
+func (h *heater) skipPrune(result cycleResult) bool {
+
+	if !h.skipPruneOnFailure || len(result.failedPulls) == 0 || result.images == 0 {
+		return false
+	}
+
+	failureRatio := float64(len(result.failedPulls)) / float64(result.images)
+	if failureRatio <= h.skipPruneFailureRatio {
+		log.Info().Float64("failureRatio", failureRatio).Msgf("Pruning, %v of %v pulls failed, which is within the failure ratio of %v", len(result.failedPulls), result.images, h.skipPruneFailureRatio)
+		return false
+	}
+
+	log.Warn().Float64("failureRatio", failureRatio).Msgf("Skipping prune to preserve the cache, %v of %v pulls failed, which exceeds the failure ratio of %v", len(result.failedPulls), result.images, h.skipPruneFailureRatio)
+
+	return true
+}
+
+// pruneImagesByDigest keeps the images in the container list and the ones to keep, and removes all other images; of
+// a kept image pulled under several tags only the tags in use are kept, so identical content is stored once
+func (h *heater) pruneImagesByDigest(ctx context.Context, containers []Container, keepImages []string) error {
+
+	keepReferences := map[string]bool{}
+	for _, c := range containers {
+		for _, reference := range getImageReferences(c.Image) {
+			keepReferences[reference] = true
+		}
+	}
+	for _, image := range keepImages {
+		for _, reference := range getImageReferences(image) {
+			keepReferences[reference] = true
+		}
+	}
+
+	images, err := h.dockerRunner.listImages(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed listing images: %v", err)
+	}
+
+	// an image is kept if any of its tags or repo digests is in use
+	removeTags := []string{}
+	keptImages := 0
+	for _, image := range images {
+		kept := false
+		for _, reference := range append(append([]string{}, image.RepoTags...), image.RepoDigests...) {
+			if keepReferences[normalizeImage(reference)] {
+				kept = true
+				break
+			}
+		}
+		if kept {
+			keptImages++
+		}
+
+		for _, tag := range image.RepoTags {
+			if tag == "<none>:<none>" || (kept && keepReferences[normalizeImage(tag)]) {
+				continue
+			}
+			removeTags = append(removeTags, tag)
+		}
+	}
+
+	log.Info().Msgf("Keeping %v of %v images, removing %v tags", keptImages, len(images), len(removeTags))
+
+	// removing the last tag of an image removes the image itself
+	failedRemovals := 0
+	for _, tag := range removeTags {
+		if err := h.dockerRunner.runDockerRemoveImage(ctx, tag); err != nil {
+			failedRemovals++
+		}
+	}
+
+	// remove the images without tags, which are unused as well
+	err = h.dockerRunner.runDockerImagePrune(ctx)
+	if err != nil {
+		return err
+	}
+
+	if failedRemovals > 0 {
+		return fmt.Errorf("Failed removing %v of %v tags", failedRemovals, len(removeTags))
+	}
+
+	return nil
+}
+
+// getImageReferences returns the normalized references an image in the container list can be found by in the local
+// store, for an image with both a tag and a digest either of them
+func getImageReferences(containerImage string) []string {
+	i := strings.Index(containerImage, "@")
+	if i < 0 {
+		return []string{normalizeImage(containerImage)}
+	}
+
+	name := containerImage[:i]
+	repository := name
+	if j := strings.LastIndex(name, ":"); j > strings.LastIndex(name, "/") {
+		repository = name[:j]
+	}
+
+	return []string{normalizeImage(containerImage), normalizeImage(name), normalizeImage(repository + containerImage[i:])}
+}
+
+// emergencyPrune prunes in the middle of a heating cycle after a pull failed because the disk is full, and returns
+// whether the pull should be retried; pulls that started before another emergency prune finished only retry
+func (h *heater) emergencyPrune(ctx context.Context, containerList ContainerList, pulledImages []string, pullStart time.Time) bool {
+
+	if h.disablePrune {
+		log.Warn().Msg("Disk of the docker daemon is full, but pruning is disabled")
+		return false
+	}
+
+	h.emergencyPruneMutex.Lock()
+	defer h.emergencyPruneMutex.Unlock()
+
+	// the space freed by a prune after this pull started may be enough already
+	if h.lastEmergencyPrune.After(pullStart) {
+		return true
+	}
+
+	log.Warn().Msg("Disk of the docker daemon is full, triggering an emergency prune")
+
+	err := h.dockerRunner.runDockerSystemPrune(ctx, h.getKeepImages(containerList, pulledImages))
+	observePrune(err)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed emergency prune")
+		return false
+	}
+
+	h.lastEmergencyPrune = time.Now()
+
+	return true
+}
+
+// getKeepImages returns the images to keep when pruning
+func (h *heater) getKeepImages(containerList ContainerList, pulledImages []string) []string {
+	keepImages := append([]string{}, h.pruneKeep...)
+	keepImages = append(keepImages, containerList.PruneKeep...)
+	if h.pruneKeepPulled {
+		keepImages = append(keepImages, pulledImages...)
+	}
+
+	return keepImages
+}
+
+// evictImages removes the older tags of each repository beyond the number of tags to keep, and then the images no
+// longer in the container list and the least recently pulled images until the total size of the images is below the
+// maximum cache size
+func (h *heater) evictImages(ctx context.Context) bool {
+
+	var err error
+	if h.keepTagsPerRepo > 0 {
+		err = h.evictOldTags(ctx)
+	}
+
+	if h.maxCacheBytes > 0 {
+		if evictErr := h.evictBySize(ctx); evictErr != nil {
+			err = evictErr
+		}
+	}
+
+	cachedImagesBytes.Set(float64(h.imageCache.totalBytes()))
+	observePrune(err)
+
+	return err == nil
+}
+
+func (h *heater) evictBySize(ctx context.Context) (err error) {
+
+	for _, i := range h.staleImages {
+		log.Info().Msgf("Removing image '%v', it's no longer in the container list", i.image)
+		if removeErr := h.dockerRunner.runDockerRemoveImage(ctx, i.image); removeErr != nil {
+			err = removeErr
+		}
+	}
+	h.staleImages = nil
+
+	totalBytes := h.imageCache.totalBytes()
+	for _, i := range h.imageCache.leastRecentlyPulled() {
+		if totalBytes <= h.maxCacheBytes {
+			break
+		}
+
+		log.Info().Msgf("Removing least recently pulled image '%v' of %v bytes, the cache of %v bytes exceeds the maximum of %v bytes", i.image, i.sizeBytes, totalBytes, h.maxCacheBytes)
+		if removeErr := h.dockerRunner.runDockerRemoveImage(ctx, i.image); removeErr != nil {
+			err = removeErr
+			continue
+		}
+		h.imageCache.remove(i.key)
+		totalBytes -= i.sizeBytes
+	}
+
+	return
+}
+
+// evictOldTags groups the pulled images by repository, including the ones no longer in the container list, and
+// removes all but the most recently pulled tags of each repository
+func (h *heater) evictOldTags(ctx context.Context) (err error) {
+
+	images := append(h.imageCache.leastRecentlyPulled(), h.staleImages...)
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].pulledAt.After(images[j].pulledAt)
+	})
+
+	stale := map[string]bool{}
+	for _, i := range h.staleImages {
+		stale[i.key] = true
+	}
+
+	// the same tag pulled for several platforms counts as a single tag
+	keptTags := map[string]map[string]bool{}
+	removedTags := map[string]bool{}
+	var remainingStaleImages []cachedImage
+	for _, i := range images {
+		repository := getImageRegistry(i.image) + "/" + getImageRepository(i.image)
+		if keptTags[repository] == nil {
+			keptTags[repository] = map[string]bool{}
+		}
+
+		tag := normalizeImage(i.image)
+		if keptTags[repository][tag] || len(keptTags[repository]) < h.keepTagsPerRepo {
+			keptTags[repository][tag] = true
+			if stale[i.key] {
+				remainingStaleImages = append(remainingStaleImages, i)
+			}
+			continue
+		}
+
+		if removedTags[tag] {
+			h.imageCache.remove(i.key)
+			continue
+		}
+
+		log.Info().Msgf("Removing image '%v', the %v more recently pulled tags of repository %v are kept", i.image, h.keepTagsPerRepo, repository)
+		if removeErr := h.dockerRunner.runDockerRemoveImage(ctx, i.image); removeErr != nil {
+			err = removeErr
+			if stale[i.key] {
+				remainingStaleImages = append(remainingStaleImages, i)
+			}
+			continue
+		}
+		removedTags[tag] = true
+		h.imageCache.remove(i.key)
+	}
+	h.staleImages = remainingStaleImages
+
+	return
+}
+
+func (h *heater) readContainerList(ctx context.Context) (containerList ContainerList, err error) {
+
+	// images can be discovered from a registry instead of listed in a file
+	if h.containerListFilePath == "" {
+		return
+	}
+
+	if !isURL(h.containerListFilePath) {
+		containerList, err = h.readContainerListFile()
+		if err == nil {
+			h.status.setContainerList(containerList)
+		}
+		return
+	}
+
+	containerList, err = h.fetchContainerList(ctx)
+	if err != nil {
+		if h.lastKnownGoodContainerList == nil {
+			return
+		}
+		log.Warn().Err(err).Msgf("Failed fetching %v, using last known good container list", h.containerListFilePath)
+		return *h.lastKnownGoodContainerList, nil
+	}
+
+	h.lastKnownGoodContainerList = &containerList
+	h.status.setContainerList(containerList)
+
+	return
+}
+
+// readContainerListFile reads the container list from a single file, or merges all files in a directory or matching a
+// glob pattern; a file that fails to read is skipped as long as at least one file is read successfully
+func (h *heater) readContainerListFile() (containerList ContainerList, err error) {
+
+	files, err := getContainerListFiles(h.containerListFilePath)
+	if err != nil {
+		return containerList, err
+	}
+
+	loadedFiles := []string{}
+	for _, file := range files {
+		fileContainerList, fileErr := h.readContainerListFromFile(file)
+		if fileErr != nil {
+			if len(files) > 1 {
+				log.Error().Err(fileErr).Msgf("Skipping container list file %v", file)
+			}
+			err = fileErr
+			continue
+		}
+		containerList.merge(fileContainerList)
+		loadedFiles = append(loadedFiles, file)
+	}
+
+	if len(loadedFiles) == 0 {
+		return containerList, err
+	}
+	if len(files) > 1 {
+		log.Info().Strs("files", loadedFiles).Msgf("Loaded %v of %v container list files", len(loadedFiles), len(files))
+	}
+
+	return containerList, h.checkNonEmpty(containerList)
+}
+
+func (h *heater) readContainerListFromFile(file string) (containerList ContainerList, err error) {
+
+	// get list of containers to preheat
+	log.Info().Msgf("Reading %v file...", file)
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return containerList, fmt.Errorf("Failed reading file %v: %v", file, err)
+	}
+
+	data, err = renderContainerList(file, data, h.valuesFile)
+	if err != nil {
+		return
+	}
+
+	return unmarshalContainerList(file, data)
+}
+
+// getContainerListFiles returns the yaml files in the directory or the files matching the glob pattern, or otherwise
+// the path itself
+func getContainerListFiles(path string) (files []string, err error) {
+
+	pattern := path
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		pattern = filepath.Join(path, "*.yaml")
+	} else if !isGlob(path) {
+		return []string{path}, nil
+	}
+
+	files, err = filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Failed listing container list files %v: %v", pattern, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No container list files match %v", pattern)
+	}
+
+	return files, nil
+}
+
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+func (h *heater) fetchContainerList(ctx context.Context) (containerList ContainerList, err error) {
+
+	log.Info().Msgf("Fetching %v...", h.containerListFilePath)
+
+	req, err := http.NewRequest(http.MethodGet, h.containerListFilePath, nil)
+	if err != nil {
+		return containerList, fmt.Errorf("Failed fetching %v: %v", h.containerListFilePath, err)
+	}
+
+	resp, err := h.containerListClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return containerList, fmt.Errorf("Failed fetching %v: %v", h.containerListFilePath, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return containerList, fmt.Errorf("Failed fetching %v: status code %v", h.containerListFilePath, resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return containerList, fmt.Errorf("Failed reading response body of %v: %v", h.containerListFilePath, err)
+	}
+
+	data, err = renderContainerList(h.containerListFilePath, data, h.valuesFile)
+	if err != nil {
+		return
+	}
+
+	containerList, err = unmarshalContainerList(h.containerListFilePath, data)
+	if err != nil {
+		return
+	}
+
+	return containerList, h.checkNonEmpty(containerList)
+}
+
+// checkNonEmpty warns when the container list has no containers, or fails if a non-empty list is required
+func (h *heater) checkNonEmpty(containerList ContainerList) error {
+
+	if len(containerList.Containers) > 0 {
+		return nil
+	}
+
+	if h.requireNonEmptyList {
+		return fmt.Errorf("Container list %v has no valid containers", h.containerListFilePath)
+	}
+	log.Warn().Msgf("Container list %v has no valid containers, nothing will be pulled", h.containerListFilePath)
+
+	return nil
+}
+
+func unmarshalContainerList(source string, data []byte) (containerList ContainerList, err error) {
+
+	// unmarshal strict, so non-defined properties or incorrect nesting will fail
+	if err = yaml.UnmarshalStrict(data, &containerList); err != nil {
+		return containerList, fmt.Errorf("Failed unmarshaling %v: %v", source, err)
+	}
+
+	if err = containerList.validate(); err != nil {
+		return containerList, fmt.Errorf("Failed validating %v: %v", source, err)
+	}
+
+	for _, image := range containerList.removeInvalidImages() {
+		log.Warn().Msgf("Skipping container with invalid image '%v' in %v", image, source)
+	}
+
+	// replace environment variable references in the registry credentials, so secrets don't have to be stored in the file
+	if err = containerList.expandEnvironmentVariables(); err != nil {
+		return containerList, fmt.Errorf("Failed expanding environment variables in %v: %v", source, err)
+	}
+
+	return
+}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// heaterStatus holds the currently loaded container list and the outcome of the last heating cycle, to inspect what
+// the heater is doing without exec'ing into the pod
+type heaterStatus struct {
+	ContainerList *ContainerList `json:"containerList"`
+	LoadedAt      *time.Time     `json:"loadedAt,omitempty"`
+	LastCycle     *cycleStatus   `json:"lastCycle,omitempty"`
+
+	// the last successful pull of each image in the container list, by container key
+	LastPulls map[string]lastPullStatus `json:"lastPulls"`
+
+	// the outcome of the last pull of each image in the container list, by container key
+	Images map[string]*imageStatus `json:"images"`
+
+	mutex sync.RWMutex
+}
+
+type cycleStatus struct {
+	FinishedAt time.Time    `json:"finishedAt"`
+	Pulls      []pullStatus `json:"pulls"`
+}
+
+type pullStatus struct {
+	Image  string `json:"image"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// lastPullStatus tells how fresh an image in the cache is
+type lastPullStatus struct {
+	Image    string    `json:"image"`
+	Platform string    `json:"platform,omitempty"`
+	PulledAt time.Time `json:"pulledAt"`
+}
+
+// imageStatus tells why an image is failing to pull, without searching the logs
+type imageStatus struct {
+	Image               string    `json:"image"`
+	Platform            string    `json:"platform,omitempty"`
+	LastPullAt          time.Time `json:"lastPullAt"`
+	LastResult          string    `json:"lastResult"`
+	LastError           string    `json:"lastError,omitempty"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	// the number of heat intervals the next pull of a failing image is backed off for, and when it's due
+	BackoffIntervals int        `json:"backoffIntervals,omitempty"`
+	BackoffUntil     *time.Time `json:"backoffUntil,omitempty"`
+}
+
+// MarshalJSON adds the age of the image at the time of the request
+func (lp lastPullStatus) MarshalJSON() ([]byte, error) {
+	// use an alias type to avoid recursing into this method
+	type lastPullStatusAlias lastPullStatus
+	return json.Marshal(struct {
+		lastPullStatusAlias
+		AgeSeconds float64 `json:"ageSeconds"`
+	}{lastPullStatusAlias(lp), time.Since(lp.PulledAt).Seconds()})
+}
+
+func newHeaterStatus() *heaterStatus {
+	return &heaterStatus{
+		LastPulls: map[string]lastPullStatus{},
+		Images:    map[string]*imageStatus{},
+	}
+}
+
+func (hs *heaterStatus) setContainerList(containerList ContainerList) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+
+	loadedAt := time.Now().UTC()
+	hs.ContainerList = &containerList
+	hs.LoadedAt = &loadedAt
+}
+
+// getContainerList returns the currently loaded container list, or an empty one if none is loaded yet
+func (hs *heaterStatus) getContainerList() ContainerList {
+	hs.mutex.RLock()
+	defer hs.mutex.RUnlock()
+
+	if hs.ContainerList == nil {
+		return ContainerList{}
+	}
+	return *hs.ContainerList
+}
+
+func (hs *heaterStatus) setCycleResult(result cycleResult) {
+	pulls := []pullStatus{}
+	for _, image := range result.pulledImages {
+		pulls = append(pulls, pullStatus{Image: image, Result: getResultLabel(nil)})
+	}
+	for _, f := range result.failedPulls {
+		pulls = append(pulls, pullStatus{Image: f.image, Result: getResultLabel(f.err), Error: f.err.Error()})
+	}
+
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+
+	hs.LastCycle = &cycleStatus{
+		FinishedAt: time.Now().UTC(),
+		Pulls:      pulls,
+	}
+}
+
+// setPullResult records the outcome of a pull of the container, counting the failures since its last successful pull;
+// it returns the number of consecutive failures
+func (hs *heaterStatus) setPullResult(container Container, err error) int {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+
+	now := time.Now().UTC()
+
+	status, ok := hs.Images[container.key()]
+	if !ok {
+		status = &imageStatus{Image: container.Image, Platform: container.Platform}
+		hs.Images[container.key()] = status
+	}
+	status.LastPullAt = now
+	status.LastResult = getResultLabel(err)
+
+	if err != nil {
+		status.LastError = err.Error()
+		status.ConsecutiveFailures++
+		return status.ConsecutiveFailures
+	}
+
+	status.LastError = ""
+	status.ConsecutiveFailures = 0
+	status.BackoffIntervals = 0
+	status.BackoffUntil = nil
+
+	hs.LastPulls[container.key()] = lastPullStatus{
+		Image:    container.Image,
+		Platform: container.Platform,
+		PulledAt: now,
+	}
+
+	return 0
+}
+
+// setBackoff records that the next pull of the failing container is backed off until the given time
+func (hs *heaterStatus) setBackoff(container Container, intervals int, until time.Time) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+
+	if status, ok := hs.Images[container.key()]; ok {
+		until = until.UTC()
+		status.BackoffIntervals = intervals
+		status.BackoffUntil = &until
+	}
+}
+
+// retainImages forgets the images that are no longer in the container list
+func (hs *heaterStatus) retainImages(keys map[string]bool) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+
+	for key := range hs.LastPulls {
+		if !keys[key] {
+			delete(hs.LastPulls, key)
+		}
+	}
+	for key := range hs.Images {
+		if !keys[key] {
+			delete(hs.Images, key)
+		}
+	}
+}
+
+func (hs *heaterStatus) getLastPulls() (lastPulls []lastPullStatus) {
+	hs.mutex.RLock()
+	defer hs.mutex.RUnlock()
+
+	for _, lastPull := range hs.LastPulls {
+		lastPulls = append(lastPulls, lastPull)
+	}
+
+	return
+}
+
+// configHandler returns the status as json; passwords of the registry credentials are left out
+func (hs *heaterStatus) configHandler(w http.ResponseWriter, r *http.Request) {
+	hs.mutex.RLock()
+	defer hs.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(hs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandTags(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/estafette/app/tags/list" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"name":"estafette/app","tags":["1.0.0","1.1.0","2.0.0","latest"]}`)
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	h := &heater{
+		registryClient: newRegistryClient([]string{registry}),
+	}
+
+	expand := func(container Container) (images []string) {
+		containers, failures := h.expandTags(context.Background(), ContainerList{Containers: []Container{container}})
+		if len(failures) > 0 {
+			t.Fatalf("Expanding tags of %v failed: %v", container.Image, failures[0].err)
+		}
+		for _, c := range containers {
+			images = append(images, strings.TrimPrefix(c.Image, registry+"/"))
+		}
+		return
+	}
+
+	t.Run("HeatsAllTagsWithAllTags", func(t *testing.T) {
+		images := expand(Container{Image: registry + "/estafette/app", AllTags: true})
+
+		expected := []string{"estafette/app:1.0.0", "estafette/app:1.1.0", "estafette/app:2.0.0", "estafette/app:latest"}
+		if !reflect.DeepEqual(images, expected) {
+			t.Errorf("Expected %v, got %v", expected, images)
+		}
+	})
+
+	t.Run("HeatsTagsFullyMatchingTagPattern", func(t *testing.T) {
+		images := expand(Container{Image: registry + "/estafette/app", TagPattern: `1\.[0-9]+\.[0-9]+`})
+
+		expected := []string{"estafette/app:1.0.0", "estafette/app:1.1.0"}
+		if !reflect.DeepEqual(images, expected) {
+			t.Errorf("Expected %v, got %v", expected, images)
+		}
+	})
+
+	t.Run("KeepsContainersWithoutAllTagsOrTagPattern", func(t *testing.T) {
+		images := expand(Container{Image: registry + "/estafette/app:latest"})
+
+		expected := []string{"estafette/app:latest"}
+		if !reflect.DeepEqual(images, expected) {
+			t.Errorf("Expected %v, got %v", expected, images)
+		}
+	})
+}
+
+func TestUpdateReadiness(t *testing.T) {
+
+	t.Run("IsReadyWithoutContainersOrFailures", func(t *testing.T) {
+		h := &heater{healthChecker: newHealthChecker(nil), pulledContainers: map[string]bool{}}
+
+		h.updateReadiness(nil, cycleResult{})
+
+		if !h.healthChecker.isReady() {
+			t.Errorf("Expected the heater to be ready with an empty container list")
+		}
+	})
+
+	t.Run("IsNotReadyWithoutContainersWithFailures", func(t *testing.T) {
+		h := &heater{healthChecker: newHealthChecker(nil), pulledContainers: map[string]bool{}}
+
+		h.updateReadiness(nil, cycleResult{failedPulls: []pullFailure{{image: "estafette/app", err: fmt.Errorf("listing tags failed")}}})
+
+		if h.healthChecker.isReady() {
+			t.Errorf("Expected the heater not to be ready when listing tags failed")
+		}
+	})
+
+	containers := []Container{
+		{Image: "estafette/critical:1.0.0", Critical: true},
+		{Image: "estafette/best-effort:1.0.0"},
+	}
+	bestEffortFailure := cycleResult{failedPulls: []pullFailure{{image: "estafette/best-effort:1.0.0", err: fmt.Errorf("manifest unknown")}}}
+
+	t.Run("IsReadyOnceCriticalImagesArePulledDespiteFailingBestEffortImages", func(t *testing.T) {
+		h := &heater{healthChecker: newHealthChecker(nil), pulledContainers: map[string]bool{}}
+
+		h.updateReadiness(containers, cycleResult{failedPulls: bestEffortFailure.failedPulls, pulledKeys: []string{"estafette/critical:1.0.0"}})
+
+		if !h.healthChecker.isReady() {
+			t.Errorf("Expected the heater to be ready once the critical image has been pulled")
+		}
+	})
+
+	t.Run("IsNotReadyWhileCriticalImagesArePending", func(t *testing.T) {
+		h := &heater{healthChecker: newHealthChecker(nil), pulledContainers: map[string]bool{}}
+
+		h.updateReadiness(containers, cycleResult{pulledKeys: []string{"estafette/best-effort:1.0.0"}})
+
+		if h.healthChecker.isReady() {
+			t.Errorf("Expected the heater not to be ready before the critical image has been pulled")
+		}
+		if h.healthChecker.pendingCriticalImages != 1 {
+			t.Errorf("Expected 1 pending critical image, got %v", h.healthChecker.pendingCriticalImages)
+		}
+	})
+
+	t.Run("RemembersCriticalImagesPulledInEarlierCycles", func(t *testing.T) {
+		h := &heater{healthChecker: newHealthChecker(nil), pulledContainers: map[string]bool{}}
+
+		h.updateReadiness(containers, cycleResult{failedPulls: bestEffortFailure.failedPulls, pulledKeys: []string{"estafette/critical:1.0.0"}})
+		h.updateReadiness(containers, bestEffortFailure)
+
+		if !h.healthChecker.isReady() || h.healthChecker.pendingCriticalImages != 0 {
+			t.Errorf("Expected the heater to stay ready without pending critical images")
+		}
+	})
+
+	t.Run("IsNotReadyWithFailingBestEffortImagesWithoutCriticalImages", func(t *testing.T) {
+		h := &heater{healthChecker: newHealthChecker(nil), pulledContainers: map[string]bool{}}
+
+		h.updateReadiness([]Container{{Image: "estafette/best-effort:1.0.0"}}, bestEffortFailure)
+
+		if h.healthChecker.isReady() {
+			t.Errorf("Expected the heater not to be ready with failing images and no critical images")
+		}
+	})
+
+	t.Run("GatesOnCriticalImagesInCycleWithoutDueImages", func(t *testing.T) {
+		containerListFile, err := ioutil.TempFile("", "container-list-*.yaml")
+		if err != nil {
+			t.Fatalf("Failed creating container list: %v", err)
+		}
+		defer os.Remove(containerListFile.Name())
+		fmt.Fprint(containerListFile, "containers:\n- image: estafette/critical:1.0.0\n  critical: true\n")
+		containerListFile.Close()
+
+		h := newHeater(nil, newHealthChecker(nil), newHeaterStatus(), newJitter(0, rand.NewSource(1)), heaterConfig{
+			containerListFilePath: containerListFile.Name(),
+			heatIntervalSeconds:   600,
+		})
+		// the critical image failed in an earlier cycle and isn't due yet
+		h.pullSchedule.schedule("estafette/critical:1.0.0", 600, time.Now())
+
+		if _, err := h.runCycle(context.Background()); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if h.healthChecker.isReady() || h.healthChecker.pendingCriticalImages != 1 {
+			t.Errorf("Expected the heater not to be ready with a pending critical image")
+		}
+
+		h.pulledContainers["estafette/critical:1.0.0"] = true
+		if _, err := h.runCycle(context.Background()); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !h.healthChecker.isReady() {
+			t.Errorf("Expected the heater to be ready once the critical image has been pulled")
+		}
+	})
+}
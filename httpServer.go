@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// httpServer serves endpoints on one or more listen addresses, endpoints configured on the same address share a server
+type httpServer struct {
+	muxes   map[string]*http.ServeMux
+	servers []*http.Server
+}
+
+func newHTTPServer() *httpServer {
+	return &httpServer{
+		muxes: map[string]*http.ServeMux{},
+	}
+}
+
+// handle serves the endpoint at the listen address; after start endpoints can only be added to addresses already served
+func (s *httpServer) handle(listenAddress, pattern string, handler http.Handler) {
+	mux, ok := s.muxes[listenAddress]
+	if !ok {
+		mux = http.NewServeMux()
+		s.muxes[listenAddress] = mux
+	}
+
+	log.Info().Msgf("Serving %v at %v...", pattern, listenAddress)
+	mux.Handle(pattern, handler)
+}
+
+func (s *httpServer) handleFunc(listenAddress, pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	s.handle(listenAddress, pattern, http.HandlerFunc(handler))
+}
+
+func (s *httpServer) start() {
+	for listenAddress, mux := range s.muxes {
+		server := &http.Server{
+			Addr:    listenAddress,
+			Handler: mux,
+		}
+		s.servers = append(s.servers, server)
+
+		go func(server *http.Server) {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal().Err(err).Msgf("Failed serving http at %v", server.Addr)
+			}
+		}(server)
+	}
+}
+
+func (s *httpServer) shutdown(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(len(s.servers))
+	for _, server := range s.servers {
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Warn().Err(err).Msgf("Failed shutting down http server at %v", server.Addr)
+			}
+		}(server)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// imageCache tracks the size and time of the last pull of each image in the container list
+type imageCache struct {
+	images map[string]cachedImage
+	mutex  sync.Mutex
+}
+
+type cachedImage struct {
+	key       string
+	image     string
+	sizeBytes int64
+	pulledAt  time.Time
+}
+
+func newImageCache() *imageCache {
+	return &imageCache{
+		images: map[string]cachedImage{},
+	}
+}
+
+func (ic *imageCache) set(key, image string, sizeBytes int64) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+
+	ic.images[key] = cachedImage{key: key, image: image, sizeBytes: sizeBytes, pulledAt: time.Now()}
+}
+
+func (ic *imageCache) remove(key string) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+
+	delete(ic.images, key)
+}
+
+// retain removes and returns the images that are no longer in the container list
+func (ic *imageCache) retain(keys map[string]bool) (removedImages []cachedImage) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+
+	for key, i := range ic.images {
+		if !keys[key] {
+			removedImages = append(removedImages, i)
+			delete(ic.images, key)
+		}
+	}
+
+	return
+}
+
+// leastRecentlyPulled returns all images ordered from the least to the most recently pulled
+func (ic *imageCache) leastRecentlyPulled() (images []cachedImage) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+
+	for _, i := range ic.images {
+		images = append(images, i)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].pulledAt.Before(images[j].pulledAt)
+	})
+
+	return
+}
+
+// totalBytes returns the summed size of all images; layers shared between images are counted for each of them
+func (ic *imageCache) totalBytes() (totalBytes int64) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+
+	for _, i := range ic.images {
+		totalBytes += i.sizeBytes
+	}
+
+	return
+}
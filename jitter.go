@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// jitter randomly deviates intervals and backoffs, to spread pulls from many heaters over time; the source of
+// randomness is injected so the deviation can be made deterministic
+type jitter struct {
+	fraction float64
+	random   *rand.Rand
+
+	// guards random, since jitter is applied from parallel pulls as well
+	mutex sync.Mutex
+}
+
+func newJitter(fraction float64, source rand.Source) *jitter {
+	return &jitter{
+		fraction: fraction,
+		random:   rand.New(source),
+	}
+}
+
+// apply returns the input with a random deviation of up to the jitter fraction in either direction
+func (j *jitter) apply(input int) (output int) {
+
+	deviation := int(j.fraction * float64(input))
+	if deviation == 0 {
+		return input
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return input - deviation + j.random.Intn(2*deviation)
+}
+
+// upTo returns a random number between 0 and max
+func (j *jitter) upTo(max int) int {
+
+	if max <= 0 {
+		return 0
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return j.random.Intn(max + 1)
+}
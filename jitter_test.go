@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestJitterApply(t *testing.T) {
+
+	t.Run("ReturnsInputWithZeroFraction", func(t *testing.T) {
+		j := newJitter(0, rand.NewSource(1))
+
+		for _, input := range []int{0, 1, 30, 900} {
+			if output := j.apply(input); output != input {
+				t.Errorf("Expected %v for input %v, got %v", input, input, output)
+			}
+		}
+	})
+
+	t.Run("ReturnsInputWhenDeviationRoundsToZero", func(t *testing.T) {
+		j := newJitter(0.1, rand.NewSource(1))
+
+		if output := j.apply(5); output != 5 {
+			t.Errorf("Expected 5, got %v", output)
+		}
+	})
+
+	t.Run("DeviatesWithinFractionFromSource", func(t *testing.T) {
+		j := newJitter(0.2, rand.NewSource(42))
+		expectedRandom := rand.New(rand.NewSource(42))
+
+		// a deviation of 20 in either direction
+		for i := 0; i < 100; i++ {
+			expected := 80 + expectedRandom.Intn(40)
+			output := j.apply(100)
+			if output != expected {
+				t.Fatalf("Expected %v, got %v", expected, output)
+			}
+			if output < 80 || output >= 120 {
+				t.Fatalf("Expected output within 80 and 120, got %v", output)
+			}
+		}
+	})
+
+	t.Run("IsDeterministicForSameSeed", func(t *testing.T) {
+		a := newJitter(0.5, rand.NewSource(7))
+		b := newJitter(0.5, rand.NewSource(7))
+
+		for i := 0; i < 10; i++ {
+			if outputA, outputB := a.apply(3600), b.apply(3600); outputA != outputB {
+				t.Fatalf("Expected the same output for the same seed, got %v and %v", outputA, outputB)
+			}
+		}
+	})
+}
+
+func TestJitterUpTo(t *testing.T) {
+
+	t.Run("ReturnsZeroForNonPositiveMax", func(t *testing.T) {
+		j := newJitter(0, rand.NewSource(1))
+
+		for _, max := range []int{0, -1} {
+			if output := j.upTo(max); output != 0 {
+				t.Errorf("Expected 0 for max %v, got %v", max, output)
+			}
+		}
+	})
+
+	t.Run("ReturnsUpToMaxInclusiveFromSource", func(t *testing.T) {
+		// the fraction doesn't apply to upTo
+		j := newJitter(0, rand.NewSource(42))
+		expectedRandom := rand.New(rand.NewSource(42))
+
+		for i := 0; i < 100; i++ {
+			expected := expectedRandom.Intn(11)
+			output := j.upTo(10)
+			if output != expected {
+				t.Fatalf("Expected %v, got %v", expected, output)
+			}
+			if output < 0 || output > 10 {
+				t.Fatalf("Expected output within 0 and 10, got %v", output)
+			}
+		}
+	})
+}
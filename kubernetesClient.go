@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	kubernetesServiceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubernetesClientTimeout      = 30 * time.Second
+	kubernetesListLimit          = 500
+)
+
+// kubernetesClient lists the images in use in the cluster the heater runs in, with the in-cluster configuration of its
+// service account
+type kubernetesClient struct {
+	serviceAccountPath string
+}
+
+func newKubernetesClient() *kubernetesClient {
+	return &kubernetesClient{
+		serviceAccountPath: kubernetesServiceAccountPath,
+	}
+}
+
+type podSpec struct {
+	InitContainers []struct {
+		Image string `json:"image"`
+	} `json:"initContainers"`
+	Containers []struct {
+		Image string `json:"image"`
+	} `json:"containers"`
+}
+
+// images returns the images of the containers and init containers
+func (ps podSpec) images() (images []string) {
+	for _, c := range ps.InitContainers {
+		images = append(images, c.Image)
+	}
+	for _, c := range ps.Containers {
+		images = append(images, c.Image)
+	}
+	return
+}
+
+type listMetadata struct {
+	Continue string `json:"continue"`
+}
+
+type podList struct {
+	Metadata listMetadata `json:"metadata"`
+	Items    []struct {
+		Spec   podSpec `json:"spec"`
+		Status struct {
+			Phase string `json:"phase"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type deploymentList struct {
+	Metadata listMetadata `json:"metadata"`
+	Items    []struct {
+		Spec struct {
+			Template struct {
+				Spec podSpec `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// listImages returns the images of the pods that haven't terminated and of the deployments in the namespace, so
+// deployments scaled to zero are heated as well
+func (kc *kubernetesClient) listImages(ctx context.Context, namespace string) (images []string, err error) {
+
+	continueToken := ""
+	for {
+		var pods podList
+		err = kc.get(ctx, fmt.Sprintf("/api/v1/namespaces/%v/pods", url.PathEscape(namespace)), continueToken, &pods)
+		if err != nil {
+			return nil, fmt.Errorf("Failed listing pods in namespace %v: %v", namespace, err)
+		}
+		for _, pod := range pods.Items {
+			if pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+				continue
+			}
+			images = append(images, pod.Spec.images()...)
+		}
+		continueToken = pods.Metadata.Continue
+		if continueToken == "" {
+			break
+		}
+	}
+
+	for {
+		var deployments deploymentList
+		err = kc.get(ctx, fmt.Sprintf("/apis/apps/v1/namespaces/%v/deployments", url.PathEscape(namespace)), continueToken, &deployments)
+		if err != nil {
+			return nil, fmt.Errorf("Failed listing deployments in namespace %v: %v", namespace, err)
+		}
+		for _, deployment := range deployments.Items {
+			images = append(images, deployment.Spec.Template.Spec.images()...)
+		}
+		continueToken = deployments.Metadata.Continue
+		if continueToken == "" {
+			break
+		}
+	}
+
+	return images, nil
+}
+
+// get requests a page of the list at the path from the kubernetes api and unmarshals the json response into target
+func (kc *kubernetesClient) get(ctx context.Context, path, continueToken string, target interface{}) error {
+
+	// the token and certificate are read for each request, since they're rotated while the heater runs
+	httpClient, err := kc.getHTTPClient()
+	if err != nil {
+		return err
+	}
+	token, err := ioutil.ReadFile(kc.serviceAccountPath + "/token")
+	if err != nil {
+		return fmt.Errorf("Failed reading service account token: %v", err)
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return fmt.Errorf("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT aren't set, the heater isn't running in kubernetes")
+	}
+
+	query := url.Values{}
+	query.Set("limit", fmt.Sprint(kubernetesListLimit))
+	if continueToken != "" {
+		query.Set("continue", continueToken)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%v%v?%v", net.JoinHostPort(host, port), path, query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Request to %v responded with status code %v", resp.Request.URL, resp.StatusCode)
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(target); err != nil {
+		return fmt.Errorf("Failed unmarshaling response of %v: %v", resp.Request.URL, err)
+	}
+
+	return nil
+}
+
+// getHTTPClient returns a client trusting the cluster's certificate authority
+func (kc *kubernetesClient) getHTTPClient() (*http.Client, error) {
+
+	caCert, err := ioutil.ReadFile(kc.serviceAccountPath + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading kubernetes ca certificate: %v", err)
+	}
+
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("No certificates found in kubernetes ca certificate %v", kc.serviceAccountPath+"/ca.crt")
+	}
+
+	return &http.Client{
+		Timeout: kubernetesClientTimeout,
+		// a client is created for each request, so its connections can't be reused
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: rootCAs},
+			DisableKeepAlives: true,
+		},
+	}, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+)
+
+// discoverKubernetesContainers returns the images used by the pods and deployments in the kubernetes namespaces, so
+// the heated images follow what's actually scheduled in the cluster
+func (h *heater) discoverKubernetesContainers(ctx context.Context) (containers []Container, failures []pullFailure) {
+
+	for _, namespace := range h.kubernetesNamespaces {
+		images, err := h.kubernetesClient.listImages(ctx, namespace)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed discovering images in kubernetes namespace %v", namespace)
+			failures = append(failures, pullFailure{image: "namespace/" + namespace, err: err})
+			continue
+		}
+
+		for _, image := range images {
+			containers = append(containers, Container{Image: image})
+		}
+
+		log.Info().Msgf("Discovered %v images in kubernetes namespace %v", len(images), namespace)
+	}
+
+	return
+}
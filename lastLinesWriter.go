@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// lastLinesWriter keeps the last lines written to it, to report what a process wrote before it failed
+type lastLinesWriter struct {
+	maxLines int
+	lines    []string
+	partial  bytes.Buffer
+	mutex    sync.Mutex
+}
+
+func newLastLinesWriter(maxLines int) *lastLinesWriter {
+	return &lastLinesWriter{
+		maxLines: maxLines,
+	}
+}
+
+func (w *lastLinesWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.partial.Write(p)
+	for {
+		line, err := w.partial.ReadString('\n')
+		if err != nil {
+			// keep the incomplete line until the rest of it is written
+			w.partial.Reset()
+			w.partial.WriteString(line)
+			break
+		}
+
+		w.lines = append(w.lines, strings.TrimRight(line, "\r\n"))
+		if len(w.lines) > w.maxLines {
+			w.lines = w.lines[len(w.lines)-w.maxLines:]
+		}
+	}
+
+	return len(p), nil
+}
+
+// String returns the kept lines, including an incomplete last line
+func (w *lastLinesWriter) String() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	lines := w.lines
+	if w.partial.Len() > 0 {
+		lines = append(lines[:len(lines):len(lines)], w.partial.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -1,23 +1,23 @@
 package main
 
 import (
-	"io/ioutil"
+	"context"
+	"io"
 	stdlog "log"
 	"math/rand"
-	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
+	"regexp"
 	"runtime"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"gopkg.in/yaml.v2"
 )
 
 var (
@@ -30,27 +30,132 @@ var (
 )
 
 var (
-	// flags
-	mtu                    = kingpin.Flag("mtu", "The network mtu").Default("1500").OverrideDefaultFromEnvar("MTU").String()
-	dockerDaemonDebug      = kingpin.Flag("debug", "To enable debug logging from the docker daemon").Default("false").OverrideDefaultFromEnvar("DEBUG").Bool()
-	registryMirror         = kingpin.Flag("registry-mirror", "An optional registry mirror address").Envar("MIRROR").String()
-	registryHealthEndpoint = kingpin.Flag("registry-health-endpoint", "An optional health endpoint on the registry to wait for").Envar("REGISTRY_HEALTH_ENDPOINT").String()
-	containerListFilePath  = kingpin.Flag("container-list-file-path", "Path to the yaml file with a list of containers to preheat").Default("/configs/container-list.yaml").OverrideDefaultFromEnvar("CONTAINER_LIST_FILE_PATH").String()
+	// commands
+	heatCommand     = kingpin.Command("heat", "Heat the cache, the default command").Default()
+	validateCommand = kingpin.Command("validate", "Validate the container list files at --container-list-file-path without heating, exiting non-zero when they have problems")
+)
 
-	// seed random number
-	r = rand.New(rand.NewSource(time.Now().UnixNano()))
+var (
+	// flags
+	mtu                     = kingpin.Flag("mtu", "The network mtu").Default("1500").OverrideDefaultFromEnvar("MTU").String()
+	logLevel                = kingpin.Flag("log-level", "The level of the heater's own logs, one of trace, debug, info, warn or error").Default("info").OverrideDefaultFromEnvar("LOG_LEVEL").Enum("trace", "debug", "info", "warn", "error")
+	logFormat               = kingpin.Flag("log-format", "The format of the heater's own logs, json or human-readable console output").Default("json").OverrideDefaultFromEnvar("LOG_FORMAT").Enum("json", "console")
+	runner                  = kingpin.Flag("runner", "The backend to pull images with, docker to pull them into a docker daemon, skopeo to copy them into a local store without a daemon or nerdctl to pull them into the host's containerd").Default("docker").OverrideDefaultFromEnvar("RUNNER").Enum("docker", "skopeo", "nerdctl")
+	skopeoDestination       = kingpin.Flag("skopeo-destination", "The local store the skopeo runner copies images to, containers-storage or oci:<directory> for an oci image layout").Default("containers-storage").OverrideDefaultFromEnvar("SKOPEO_DESTINATION").String()
+	containerdAddress       = kingpin.Flag("containerd-address", "The socket of the host's containerd the nerdctl runner pulls into").Default("/run/containerd/containerd.sock").OverrideDefaultFromEnvar("CONTAINERD_ADDRESS").String()
+	containerdNamespace     = kingpin.Flag("containerd-namespace", "The containerd namespace the nerdctl runner pulls into, k8s.io for the images used by kubernetes").Default("k8s.io").OverrideDefaultFromEnvar("CONTAINERD_NAMESPACE").String()
+	manageDaemon            = kingpin.Flag("manage-daemon", "Start and supervise a docker daemon, or use the external daemon at DOCKER_HOST when false; the daemon flags only apply when true").Default("true").OverrideDefaultFromEnvar("MANAGE_DAEMON").Bool()
+	dockerHosts             = kingpin.Flag("docker-host", "An address for the started docker daemon to listen on, can be repeated or comma-separated; the heater uses the first one").Default("unix:///var/run/docker.sock").Envar("DOCKER_HOSTS").Strings()
+	enableTCPHost           = kingpin.Flag("enable-tcp-host", "Let the started docker daemon listen on "+tcpDockerHost+" as well, without authentication, like before it only listened on the unix socket by default").Default("false").OverrideDefaultFromEnvar("ENABLE_TCP_HOST").Bool()
+	dockerDaemonDebug       = kingpin.Flag("debug", "To enable debug logging from the docker daemon").Default("false").OverrideDefaultFromEnvar("DEBUG").Bool()
+	storageDriver           = kingpin.Flag("storage-driver", "The storage driver for the docker daemon").Default("overlay2").OverrideDefaultFromEnvar("STORAGE_DRIVER").String()
+	dockerDataRoot          = kingpin.Flag("docker-data-root", "The directory the docker daemon stores its images in, created if missing, for example on a dedicated fast disk; dockerd's default /var/lib/docker if empty").Default("").OverrideDefaultFromEnvar("DOCKER_DATA_ROOT").String()
+	daemonMaxDownloads      = kingpin.Flag("daemon-max-concurrent-downloads", "The maximum number of layers the docker daemon downloads at the same time, independent of --max-concurrent-pulls").Default("10").OverrideDefaultFromEnvar("DAEMON_MAX_CONCURRENT_DOWNLOADS").Int()
+	insecureRegistries      = kingpin.Flag("insecure-registry", "A registry to pull from over plain http or with an untrusted certificate, can be repeated or comma-separated").Envar("INSECURE_REGISTRIES").Strings()
+	daemonConfigFile        = kingpin.Flag("daemon-config-file", "Render the docker daemon configuration to this daemon.json file and start dockerd with it, instead of passing the configuration as arguments").Envar("DAEMON_CONFIG_FILE").String()
+	daemonConfigJSON        = kingpin.Flag("daemon-config-json", "A json object merged into the rendered daemon.json, replacing the generated top level keys").Envar("DAEMON_CONFIG_JSON").String()
+	daemonArgs              = kingpin.Flag("daemon-arg", "An argument appended verbatim to the dockerd command after the built-in arguments, can be repeated").Envar("DAEMON_ARGS").Strings()
+	daemonStartupTimeout    = kingpin.Flag("daemon-startup-timeout-seconds", "The number of seconds to wait for the docker daemon or containerd to be ready before exiting with its output").Default("120").OverrideDefaultFromEnvar("DAEMON_STARTUP_TIMEOUT_SECONDS").Int()
+	daemonStderrLines       = kingpin.Flag("daemon-stderr-lines", "The number of lines the docker daemon last wrote to stderr to log when it fails to start or exits").Default("50").OverrideDefaultFromEnvar("DAEMON_STDERR_LINES").Int()
+	daemonStartRetries      = kingpin.Flag("daemon-start-retries", "The number of times to start the docker daemon again when it fails to start, with backoff, before the heater exits").Default("3").OverrideDefaultFromEnvar("DAEMON_START_RETRIES").Int()
+	daemonMaxRestarts       = kingpin.Flag("daemon-max-restarts", "The number of times a crashed docker daemon is restarted before the heater exits").Default("5").OverrideDefaultFromEnvar("DAEMON_MAX_RESTARTS").Int()
+	registryMirrors         = kingpin.Flag("registry-mirror", "An optional registry mirror url for docker hub images, can be repeated or comma-separated to try several mirrors in order").Envar("MIRROR").Strings()
+	registryMirrorCreds     = kingpin.Flag("registry-mirror-credentials", "The credentials for a registry mirror that requires authentication as mirror=username:password, like mirror.example.com=user:secret, can be repeated").Envar("MIRROR_CREDENTIALS").Strings()
+	registryHealthEndpoints = kingpin.Flag("registry-health-endpoint", "An optional health endpoint on a registry to wait for, can be repeated or comma-separated to wait for all of them").Envar("REGISTRY_HEALTH_ENDPOINT").Strings()
+	registryHealthTimeout   = kingpin.Flag("registry-health-timeout-seconds", "The number of seconds to wait for the registry health endpoint before giving up, 0 waits indefinitely").Default("0").OverrideDefaultFromEnvar("REGISTRY_HEALTH_TIMEOUT_SECONDS").Int()
+	registryHealthHeaders   = kingpin.Flag("registry-health-header", "A header in the form 'Name: value' sent to the registry health endpoints, can be repeated").Envar("REGISTRY_HEALTH_HEADERS").Strings()
+	registryHealthCACert    = kingpin.Flag("registry-health-ca-cert-path", "Path to a pem encoded ca certificate to trust when calling the registry health endpoints").Envar("REGISTRY_HEALTH_CA_CERT_PATH").String()
+	registryHealthInsecure  = kingpin.Flag("registry-health-insecure-skip-verify", "Skip verifying the certificate of the registry health endpoints").Default("false").OverrideDefaultFromEnvar("REGISTRY_HEALTH_INSECURE_SKIP_VERIFY").Bool()
+	registryHealthRequired  = kingpin.Flag("registry-health-required", "Exit when the registry health endpoint isn't ready within the timeout instead of continuing anyway").Default("false").OverrideDefaultFromEnvar("REGISTRY_HEALTH_REQUIRED").Bool()
+	metricsListenAddress    = kingpin.Flag("metrics-listen-address", "The address to serve prometheus metrics on").Default(":9101").OverrideDefaultFromEnvar("METRICS_LISTEN_ADDRESS").String()
+	natsURL                 = kingpin.Flag("nats-url", "An optional nats server as nats://[user:password@]host[:port] to publish an event for each pull to").Envar("NATS_URL").String()
+	natsSubject             = kingpin.Flag("nats-subject", "The nats subject to publish the pull events to").Default("estafette.docker-cache-heater.pulls").OverrideDefaultFromEnvar("NATS_SUBJECT").String()
+	statsdAddress           = kingpin.Flag("statsd-address", "An optional statsd or dogstatsd host:port to send the pull and prune metrics to over udp, in addition to the prometheus endpoint").Envar("STATSD_ADDRESS").String()
+	dryRun                  = kingpin.Flag("dry-run", "Log the docker commands for pulling and pruning a single heating cycle instead of running them and exit, without starting the docker daemon").Default("false").OverrideDefaultFromEnvar("DRY_RUN").Bool()
+	runOnce                 = kingpin.Flag("run-once", "Run a single heating cycle and exit, with a non-zero exit code if any pull failed").Default("false").OverrideDefaultFromEnvar("RUN_ONCE").Bool()
+	completionWebhookURL    = kingpin.Flag("completion-webhook-url", "An optional url to post the outcome of each heating cycle to as json").Envar("COMPLETION_WEBHOOK_URL").String()
+	slackWebhookURL         = kingpin.Flag("slack-webhook-url", "An optional slack incoming webhook url to alert when an image fails to pull repeatedly").Envar("SLACK_WEBHOOK_URL").String()
+	slackFailureThreshold   = kingpin.Flag("slack-failure-threshold", "The number of consecutive heating cycles an image has to fail to pull in before alerting slack").Default("3").OverrideDefaultFromEnvar("SLACK_FAILURE_THRESHOLD").Int()
+	httpProxy               = kingpin.Flag("http-proxy", "The proxy for http requests of the docker daemon, pulls and the heater itself, as an http, https or socks5 url").Default("").OverrideDefaultFromEnvar("HTTP_PROXY").String()
+	httpsProxy              = kingpin.Flag("https-proxy", "The proxy for https requests of the docker daemon, pulls and the heater itself, as an http, https or socks5 url").Default("").OverrideDefaultFromEnvar("HTTPS_PROXY").String()
+	noProxy                 = kingpin.Flag("no-proxy", "A comma-separated list of hosts, domains and cidrs to reach without the proxy").Default("").OverrideDefaultFromEnvar("NO_PROXY").String()
+	maxLifetimeHours        = kingpin.Flag("max-lifetime-hours", "Shut down after the heating cycle running once this many hours have passed, so kubernetes restarts the pod with a fresh docker daemon; 0 runs indefinitely").Default("0").OverrideDefaultFromEnvar("MAX_LIFETIME_HOURS").Int()
+	shutdownGracePeriod     = kingpin.Flag("shutdown-grace-period-seconds", "The number of seconds to wait for in-flight pulls to stop when shutting down").Default("20").OverrideDefaultFromEnvar("SHUTDOWN_GRACE_PERIOD_SECONDS").Int()
+	pullTriggerSecret       = kingpin.Flag("pull-trigger-secret", "A shared secret requests to the /pull endpoint have to pass in the X-Pull-Trigger-Secret header").Default("").OverrideDefaultFromEnvar("PULL_TRIGGER_SECRET").String()
+	healthListenAddress     = kingpin.Flag("health-listen-address", "The address to serve the /liveness and /readiness endpoints on").Default(":5000").OverrideDefaultFromEnvar("HEALTH_LISTEN_ADDRESS").String()
+	valuesFile              = kingpin.Flag("values-file", "A yaml file with values to render the container list files with as go templates, like {{ .appVersion }} in an image tag").Default("").OverrideDefaultFromEnvar("VALUES_FILE").String()
+	containerListFilePath   = kingpin.Flag("container-list-file-path", "Path, directory, glob pattern or http(s) url of the yaml file(s) with a list of containers to preheat, can be empty when discovering images from a registry or kubernetes").Default("/configs/container-list.yaml").OverrideDefaultFromEnvar("CONTAINER_LIST_FILE_PATH").String()
+	requireNonEmptyList     = kingpin.Flag("require-non-empty-list", "Fail the heating cycle instead of only warning when the container list has no valid containers").Default("false").OverrideDefaultFromEnvar("REQUIRE_NON_EMPTY_LIST").Bool()
+	containerListRetry      = kingpin.Flag("container-list-retry-seconds", "The number of seconds after which to try again when the container list can't be read or parsed, instead of waiting for the heat interval; 0 waits for the heat interval").Default("30").OverrideDefaultFromEnvar("CONTAINER_LIST_RETRY_SECONDS").Int()
+	containerListTimeout    = kingpin.Flag("container-list-fetch-timeout-seconds", "The number of seconds after which fetching the container list from a url times out").Default("30").OverrideDefaultFromEnvar("CONTAINER_LIST_FETCH_TIMEOUT_SECONDS").Int()
+	discoveryRegistry       = kingpin.Flag("discovery-registry", "An optional registry to discover the images to preheat from by listing its catalog, in addition to the container list").Envar("DISCOVERY_REGISTRY").String()
+	discoveryTagsPerRepo    = kingpin.Flag("discovery-tags-per-repo", "The number of most recently created tags to preheat for each repository in the discovery registry").Default("1").OverrideDefaultFromEnvar("DISCOVERY_TAGS_PER_REPO").Int()
+	discoveryRepoFilter     = kingpin.Flag("discovery-repo-filter", "A regular expression repositories in the discovery registry have to match to be preheated").Envar("DISCOVERY_REPO_FILTER").String()
+	maxImageAgeDays         = kingpin.Flag("max-image-age-days", "Skip discovered tags whose image was created more than this number of days ago; 0 disables the limit").Default("0").OverrideDefaultFromEnvar("MAX_IMAGE_AGE_DAYS").Int()
+	kubernetesNamespaces    = kingpin.Flag("kubernetes-namespace", "A kubernetes namespace to heat the images used by its pods and deployments of, in addition to the container list; can be repeated or comma-separated").Envar("KUBERNETES_NAMESPACES").Strings()
+	imageInclude            = kingpin.Flag("image-include", "A regular expression images have to match to be heated, can be repeated to match any of them").Envar("IMAGE_INCLUDE").Strings()
+	imageExclude            = kingpin.Flag("image-exclude", "A regular expression for images to leave out, can be repeated").Envar("IMAGE_EXCLUDE").Strings()
+	defaultPlatform         = kingpin.Flag("default-platform", "The platform to pull images for if not set on the container, defaults to the host's platform").Envar("DEFAULT_PLATFORM").String()
+	disablePrune            = kingpin.Flag("disable-prune", "Skip pruning after each heating cycle").Default("false").OverrideDefaultFromEnvar("DISABLE_PRUNE").Bool()
+	pruneByDigest           = kingpin.Flag("prune-by-digest", "Instead of pruning everything, only remove the images that aren't in the container list, keeping one copy of images pulled under several tags").Default("false").OverrideDefaultFromEnvar("PRUNE_BY_DIGEST").Bool()
+	skipPruneOnFailure      = kingpin.Flag("skip-prune-on-failure", "Skip the prune when pulls failed in the heating cycle, to preserve the images that are already cached").Default("false").OverrideDefaultFromEnvar("SKIP_PRUNE_ON_FAILURE").Bool()
+	skipPruneFailureRatio   = kingpin.Flag("skip-prune-failure-ratio", "With --skip-prune-on-failure only skip the prune when more than this ratio of the pulls failed; 0 skips it on any failure").Default("0").OverrideDefaultFromEnvar("SKIP_PRUNE_FAILURE_RATIO").Float64()
+	pruneEveryNCycles       = kingpin.Flag("prune-every-n-cycles", "Only prune in the first and then every nth heating cycle, to keep more warm layers between prunes when the images hardly change").Default("1").OverrideDefaultFromEnvar("PRUNE_EVERY_N_CYCLES").Int()
+	postPruneCooldown       = kingpin.Flag("post-prune-cooldown-seconds", "The minimum number of seconds to wait after a prune before the next heating cycle pulls again, with jitter applied, so heaters that just pruned don't all pull everything at once").Default("0").OverrideDefaultFromEnvar("POST_PRUNE_COOLDOWN_SECONDS").Int()
+	pruneVolumes            = kingpin.Flag("prune-volumes", "Prune unused volumes as well when pruning the docker system").Default("false").OverrideDefaultFromEnvar("PRUNE_VOLUMES").Bool()
+	pruneBuildCache         = kingpin.Flag("prune-build-cache", "Prune the build cache when pruning the docker system, disable with --no-prune-build-cache").Default("true").OverrideDefaultFromEnvar("PRUNE_BUILD_CACHE").Bool()
+	pruneDanglingOnly       = kingpin.Flag("prune-dangling-only", "Only prune dangling images instead of all unused containers, images, networks and build cache").Default("false").OverrideDefaultFromEnvar("PRUNE_DANGLING_ONLY").Bool()
+	pruneDiskThreshold      = kingpin.Flag("prune-disk-threshold-percent", "Only prune when the disk usage of the docker data root exceeds this percentage").Default("0").OverrideDefaultFromEnvar("PRUNE_DISK_THRESHOLD_PERCENT").Float64()
+	pruneKeep               = kingpin.Flag("prune-keep", "A container image to keep when pruning, can be repeated").Envar("PRUNE_KEEP").Strings()
+	maxCacheBytes           = kingpin.Flag("max-cache-bytes", "Instead of pruning everything, remove the least recently pulled images once the images in the container list exceed this size, 0 disables it").Default("0").OverrideDefaultFromEnvar("MAX_CACHE_BYTES").Int64()
+	keepTagsPerRepo         = kingpin.Flag("keep-tags-per-repo", "Instead of pruning everything, remove all but this many of the most recently pulled tags of each repository, 0 keeps all tags").Default("0").OverrideDefaultFromEnvar("KEEP_TAGS_PER_REPO").Int()
+	pruneKeepPulled         = kingpin.Flag("prune-keep-pulled", "Keep all images pulled in the current cycle when pruning").Default("false").OverrideDefaultFromEnvar("PRUNE_KEEP_PULLED").Bool()
+	jitterSeed              = kingpin.Flag("jitter-seed", "Seed for the jitter to make it deterministic, 0 seeds it from the current time").Default("0").OverrideDefaultFromEnvar("JITTER_SEED").Hidden().Int64()
+	jitterFraction          = kingpin.Flag("jitter-fraction", "The fraction by which intervals and backoffs deviate randomly, to spread pulls from many heaters over time").Default("0.25").OverrideDefaultFromEnvar("JITTER_FRACTION").Float64()
+	startupJitterSeconds    = kingpin.Flag("startup-jitter-seconds", "Wait a random number of seconds up to this value before the first heating cycle, so heaters restarted at the same time don't all pull at once").Default("0").OverrideDefaultFromEnvar("STARTUP_JITTER_SECONDS").Int()
+	heatIntervalSeconds     = kingpin.Flag("heat-interval-seconds", "The number of seconds between pulls of the same image, with jitter applied, unless the container sets intervalSeconds").Default("900").OverrideDefaultFromEnvar("HEAT_INTERVAL_SECONDS").Int()
+	staggerPulls            = kingpin.Flag("stagger-pulls", "Spread the pulls evenly over the heat interval instead of starting them all at the start of the heating cycle").Default("false").OverrideDefaultFromEnvar("STAGGER_PULLS").Bool()
+	pullMaxRetries          = kingpin.Flag("pull-max-retries", "The number of times a failing pull is retried with exponential backoff").Default("3").OverrideDefaultFromEnvar("PULL_MAX_RETRIES").Int()
+	pullProgress            = kingpin.Flag("pull-progress", "Log the progress of each layer being pulled instead of a single line per image").Default("false").OverrideDefaultFromEnvar("PULL_PROGRESS").Bool()
+	contentTrust            = kingpin.Flag("enable-content-trust", "Only pull signed images, by pulling with the docker cli with DOCKER_CONTENT_TRUST=1").Default("false").OverrideDefaultFromEnvar("ENABLE_CONTENT_TRUST").Bool()
+	quietPulls              = kingpin.Flag("quiet-pulls", "Only log a single line with the duration for each pulled image, recommended in production").Default("false").OverrideDefaultFromEnvar("QUIET_PULLS").Bool()
+	dockerConfigPath        = kingpin.Flag("docker-config-path", "A docker config.json file with the credentials for registries that have no credentials in the container list, like a mounted dockerconfigjson secret").Default("").OverrideDefaultFromEnvar("DOCKER_CONFIG_PATH").String()
+	registryConcurrency     = kingpin.Flag("registry-concurrency", "The maximum number of parallel pulls from a registry as registry=limit, like docker.io=2, can be repeated or comma-separated").Envar("REGISTRY_CONCURRENCY").Strings()
+	sequential              = kingpin.Flag("sequential", "Pull one image at a time in the order of the container list instead of in parallel, for small nodes where any parallelism causes thrashing").Default("false").OverrideDefaultFromEnvar("SEQUENTIAL").Bool()
+	maxConcurrentPulls      = kingpin.Flag("max-concurrent-pulls", "The maximum number of images pulled at the same time").Default("10").OverrideDefaultFromEnvar("MAX_CONCURRENT_PULLS").Int()
+	initialConcurrentPulls  = kingpin.Flag("initial-concurrent-pulls", "The number of images pulled at the same time in the first heating cycle, ramping up to --max-concurrent-pulls over the next cycles so a cold node's disk isn't overwhelmed; 0 starts at the maximum").Default("0").OverrideDefaultFromEnvar("INITIAL_CONCURRENT_PULLS").Int()
+	concurrentPullsStep     = kingpin.Flag("concurrent-pulls-ramp-step", "The number of images pulled at the same time is increased by this much after each heating cycle when ramping up from --initial-concurrent-pulls").Default("2").OverrideDefaultFromEnvar("CONCURRENT_PULLS_RAMP_STEP").Int()
+	pullNice                = kingpin.Flag("pull-nice", "Run the processes doing the pulls with this niceness, from 0 to 19, so they don't starve the node's other workloads; for the docker runner this is the started docker daemon").Default("0").OverrideDefaultFromEnvar("PULL_NICE").Int()
+	pullIoniceClass         = kingpin.Flag("pull-ionice-class", "Run the processes doing the pulls in this io scheduling class, best-effort or idle, to deprioritize their disk io").Default("").OverrideDefaultFromEnvar("PULL_IONICE_CLASS").String()
+	failureBackoffMax       = kingpin.Flag("failure-backoff-max-intervals", "Retry an image that keeps failing less often, doubling the number of heat intervals between its pulls with each consecutive failure up to this maximum; 1 retries it every interval").Default("1").OverrideDefaultFromEnvar("FAILURE_BACKOFF_MAX_INTERVALS").Int()
+	rateLimitCooldown       = kingpin.Flag("rate-limit-cooldown-minutes", "The number of minutes to skip the images of a registry after it rate limited a pull with toomanyrequests, so the limit can reset; 0 disables the cooldown and retries rate limited pulls like other failed pulls").Default("30").OverrideDefaultFromEnvar("RATE_LIMIT_COOLDOWN_MINUTES").Int()
+	imageTarballDir         = kingpin.Flag("image-tarball-dir", "A directory with tarballs created with docker save, named after the image with slashes and colons replaced by underscores, to load images from when pulling them fails").Default("").OverrideDefaultFromEnvar("IMAGE_TARBALL_DIR").String()
+	auditLogPath            = kingpin.Flag("audit-log-path", "Append a json line for each pull, load, image removal and prune to this file, as an audit record separate from the logs").Default("").OverrideDefaultFromEnvar("AUDIT_LOG_PATH").String()
+	pullTimeoutSeconds      = kingpin.Flag("pull-timeout-seconds", "The number of seconds after which a single pull attempt is killed").Default("600").OverrideDefaultFromEnvar("PULL_TIMEOUT_SECONDS").Int()
 )
 
 func main() {
 
+	// to measure how long it takes for the cache to become warm
+	startedAt := time.Now()
+
 	// parse command line parameters
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	// log as severity for stackdriver logging to recognize the level
 	zerolog.LevelFieldName = "severity"
 
+	// the level is validated by kingpin
+	level, _ := zerolog.ParseLevel(*logLevel)
+	zerolog.SetGlobalLevel(level)
+
+	var logWriter io.Writer = os.Stdout
+	if *logFormat == "console" {
+		logWriter = zerolog.ConsoleWriter{Out: os.Stdout}
+	}
+
 	// set some default fields added to all logs
-	log.Logger = zerolog.New(os.Stdout).With().
+	log.Logger = zerolog.New(logWriter).With().
 		Timestamp().
 		Str("app", app).
 		Str("version", version).
@@ -60,106 +165,609 @@ func main() {
 	stdlog.SetFlags(0)
 	stdlog.SetOutput(log.Logger)
 
+	// check the container list in ci without starting the docker daemon
+	if command == validateCommand.FullCommand() {
+		if !validateContainerListFiles(*containerListFilePath, *valuesFile, os.Stdout) {
+			os.Exit(exitCodeConfigInvalid)
+		}
+		return
+	}
+
 	// log startup message
 	log.Info().
 		Str("branch", branch).
 		Str("revision", revision).
 		Str("buildDate", buildDate).
 		Str("goVersion", goVersion).
+		Str("logLevel", *logLevel).
+		Str("logFormat", *logFormat).
+		Str("runner", *runner).
+		Str("skopeoDestination", *skopeoDestination).
+		Str("containerdAddress", *containerdAddress).
+		Str("containerdNamespace", *containerdNamespace).
+		Bool("manageDaemon", *manageDaemon).
+		Strs("dockerHosts", splitCommaSeparated(*dockerHosts)).
+		Bool("enableTCPHost", *enableTCPHost).
 		Str("mtu", *mtu).
-		Str("registryMirror", *registryMirror).
+		Strs("registryMirrors", splitCommaSeparated(*registryMirrors)).
+		Int("registryMirrorCredentials", len(*registryMirrorCreds)).
+		Strs("registryHealthEndpoints", splitCommaSeparated(*registryHealthEndpoints)).
+		Int("registryHealthTimeoutSeconds", *registryHealthTimeout).
+		Bool("registryHealthRequired", *registryHealthRequired).
+		Int("registryHealthHeaders", len(*registryHealthHeaders)).
+		Str("registryHealthCACertPath", *registryHealthCACert).
+		Bool("registryHealthInsecureSkipVerify", *registryHealthInsecure).
+		Str("storageDriver", *storageDriver).
+		Str("dockerDataRoot", *dockerDataRoot).
+		Int("daemonMaxConcurrentDownloads", *daemonMaxDownloads).
+		Strs("insecureRegistries", splitCommaSeparated(*insecureRegistries)).
+		Strs("daemonArgs", *daemonArgs).
+		Str("daemonConfigFile", *daemonConfigFile).
+		Int("daemonStartupTimeoutSeconds", *daemonStartupTimeout).
+		Int("daemonStderrLines", *daemonStderrLines).
+		Int("daemonStartRetries", *daemonStartRetries).
+		Int("daemonMaxRestarts", *daemonMaxRestarts).
+		Bool("requireNonEmptyList", *requireNonEmptyList).
+		Str("defaultPlatform", *defaultPlatform).
+		Str("discoveryRegistry", *discoveryRegistry).
+		Int("discoveryTagsPerRepo", *discoveryTagsPerRepo).
+		Str("discoveryRepoFilter", *discoveryRepoFilter).
+		Int("maxImageAgeDays", *maxImageAgeDays).
+		Strs("kubernetesNamespaces", splitCommaSeparated(*kubernetesNamespaces)).
+		Strs("imageInclude", *imageInclude).
+		Strs("imageExclude", *imageExclude).
+		Int("startupJitterSeconds", *startupJitterSeconds).
+		Int("heatIntervalSeconds", *heatIntervalSeconds).
+		Int("containerListRetrySeconds", *containerListRetry).
+		Bool("staggerPulls", *staggerPulls).
+		Float64("jitterFraction", *jitterFraction).
+		Int64("jitterSeed", *jitterSeed).
+		Int("pullMaxRetries", *pullMaxRetries).
+		Int("pullTimeoutSeconds", *pullTimeoutSeconds).
+		Bool("pullProgress", *pullProgress).
+		Bool("quietPulls", *quietPulls).
+		Bool("contentTrust", *contentTrust).
+		Bool("sequential", *sequential).
+		Strs("registryConcurrency", splitCommaSeparated(*registryConcurrency)).
+		Str("dockerConfigPath", *dockerConfigPath).
+		Int("maxConcurrentPulls", *maxConcurrentPulls).
+		Int("initialConcurrentPulls", *initialConcurrentPulls).
+		Int("concurrentPullsRampStep", *concurrentPullsStep).
+		Int("pullNice", *pullNice).
+		Str("pullIoniceClass", *pullIoniceClass).
+		Int("failureBackoffMaxIntervals", *failureBackoffMax).
+		Int("rateLimitCooldownMinutes", *rateLimitCooldown).
+		Str("imageTarballDir", *imageTarballDir).
+		Str("auditLogPath", *auditLogPath).
+		Bool("runOnce", *runOnce).
+		Int("maxLifetimeHours", *maxLifetimeHours).
+		Bool("httpProxy", *httpProxy != "").
+		Bool("httpsProxy", *httpsProxy != "").
+		Str("noProxy", *noProxy).
+		Str("statsdAddress", *statsdAddress).
+		Bool("nats", *natsURL != "").
+		Str("natsSubject", *natsSubject).
+		Bool("dryRun", *dryRun).
+		Bool("completionWebhook", *completionWebhookURL != "").
+		Bool("slackWebhook", *slackWebhookURL != "").
+		Bool("pullTriggerSecret", *pullTriggerSecret != "").
+		Int("slackFailureThreshold", *slackFailureThreshold).
+		Bool("disablePrune", *disablePrune).
+		Bool("pruneByDigest", *pruneByDigest).
+		Int("pruneEveryNCycles", *pruneEveryNCycles).
+		Bool("skipPruneOnFailure", *skipPruneOnFailure).
+		Float64("skipPruneFailureRatio", *skipPruneFailureRatio).
+		Int("postPruneCooldownSeconds", *postPruneCooldown).
+		Bool("pruneVolumes", *pruneVolumes).
+		Bool("pruneBuildCache", *pruneBuildCache).
+		Bool("pruneDanglingOnly", *pruneDanglingOnly).
+		Strs("pruneKeep", *pruneKeep).
+		Bool("pruneKeepPulled", *pruneKeepPulled).
+		Int64("maxCacheBytes", *maxCacheBytes).
+		Int("keepTagsPerRepo", *keepTagsPerRepo).
+		Float64("pruneDiskThresholdPercent", *pruneDiskThreshold).
 		Msgf("Starting %v version %v...", app, version)
 
+	if *jitterFraction < 0 || *jitterFraction > 1 {
+		log.Fatal().Msgf("Jitter fraction %v is not between 0 and 1", *jitterFraction)
+	}
+
+	if *quietPulls && *pullProgress {
+		log.Fatal().Msg("Pull progress and quiet pulls can't be combined")
+	}
+
+	if *contentTrust && *runner != "docker" {
+		log.Fatal().Msgf("Content trust is only supported by the docker runner, not by %v", *runner)
+	}
+	if *contentTrust && *manageDaemon && !isExperimentalDaemon(*daemonArgs, *daemonConfigFile, *daemonConfigJSON) {
+		if *defaultPlatform != "" {
+			log.Fatal().Msgf("Content trust with default platform %v needs the docker daemon in experimental mode, add --daemon-arg=--experimental", *defaultPlatform)
+		}
+		log.Warn().Msg("Content trust pulls for a platform need the docker daemon in experimental mode, add --daemon-arg=--experimental if the container list sets a platform")
+	}
+
+	if *pruneByDigest && *runner == "skopeo" {
+		log.Fatal().Msg("Pruning by digest isn't supported by the skopeo runner")
+	}
+
+	if *daemonStartupTimeout < 1 {
+		log.Fatal().Msgf("Daemon startup timeout of %v seconds is less than 1", *daemonStartupTimeout)
+	}
+
+	if *initialConcurrentPulls < 0 || *initialConcurrentPulls > *maxConcurrentPulls {
+		log.Fatal().Msgf("Initial concurrent pulls %v is not between 0 and the max concurrent pulls %v", *initialConcurrentPulls, *maxConcurrentPulls)
+	}
+
+	for _, proxy := range []string{*httpProxy, *httpsProxy} {
+		if err := validateProxy(proxy); err != nil {
+			log.Fatal().Err(err).Msg("Invalid proxy")
+		}
+	}
+	// set before anything makes a request, since go's http client reads the proxy environment variables only once
+	setProxyEnvironment(*httpProxy, *httpsProxy, *noProxy)
+
+	if *maxLifetimeHours < 0 {
+		log.Fatal().Msgf("Max lifetime of %v hours is negative", *maxLifetimeHours)
+	}
+
+	if *skipPruneFailureRatio < 0 || *skipPruneFailureRatio >= 1 {
+		log.Fatal().Msgf("Skip prune failure ratio %v is not between 0 and 1", *skipPruneFailureRatio)
+	}
+
+	if *pruneEveryNCycles < 1 {
+		log.Fatal().Msgf("Prune every %v cycles is less than 1", *pruneEveryNCycles)
+	}
+
+	if *postPruneCooldown < 0 {
+		log.Fatal().Msgf("Post prune cooldown of %v seconds is negative", *postPruneCooldown)
+	}
+
+	if *daemonStartRetries < 0 {
+		log.Fatal().Msgf("Daemon start retries %v is negative", *daemonStartRetries)
+	}
+
+	if *containerListRetry < 0 {
+		log.Fatal().Msgf("Container list retry of %v seconds is negative", *containerListRetry)
+	}
+
+	if *failureBackoffMax < 1 {
+		log.Fatal().Msgf("Failure backoff max intervals %v is less than 1", *failureBackoffMax)
+	}
+
+	if *concurrentPullsStep < 1 {
+		log.Fatal().Msgf("Concurrent pulls ramp step %v is less than 1", *concurrentPullsStep)
+	}
+
+	if *dockerConfigPath != "" {
+		if _, err := readDockerConfig(*dockerConfigPath); err != nil {
+			log.Fatal().Err(err).Msg("Invalid docker config path")
+		}
+	}
+
+	registryMirrorCredentials, err := parseRegistryMirrorCredentials(*registryMirrorCreds)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid registry mirror credentials")
+	}
+
+	registryConcurrencyLimits, err := parseRegistryConcurrency(splitCommaSeparated(*registryConcurrency))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid registry concurrency")
+	}
+
+	pullPriority := pullPriority{nice: *pullNice, ioniceClass: *pullIoniceClass}
+	if err := validatePullPriority(pullPriority); err != nil {
+		log.Fatal().Err(err).Msg("Invalid pull priority")
+	}
+	if pullPriority.isSet() && *runner == "docker" && !*manageDaemon {
+		log.Warn().Msg("The pull priority only applies to a docker daemon started by the heater, not to the one at DOCKER_HOST")
+	}
+
+	if *slackFailureThreshold < 1 {
+		log.Fatal().Msgf("Slack failure threshold %v is less than 1", *slackFailureThreshold)
+	}
+
+	if *maxImageAgeDays < 0 {
+		log.Fatal().Msgf("Max image age of %v days is negative", *maxImageAgeDays)
+	}
+
+	if _, err := regexp.Compile(*discoveryRepoFilter); err != nil {
+		log.Fatal().Err(err).Msg("Invalid discovery repo filter")
+	}
+
+	for _, expression := range append(append([]string{}, *imageInclude...), *imageExclude...) {
+		if _, err := regexp.Compile(expression); err != nil {
+			log.Fatal().Err(err).Msgf("Invalid image include or exclude expression %v", expression)
+		}
+	}
+
+	// seed random number
+	jitterSource := rand.NewSource(time.Now().UnixNano())
+	if *jitterSeed != 0 {
+		jitterSource = rand.NewSource(*jitterSeed)
+	}
+	jitter := newJitter(*jitterFraction, jitterSource)
+
 	// define channel used to gracefully shutdown the application
-	gracefulShutdown := make(chan os.Signal)
+	gracefulShutdown := make(chan os.Signal, 1)
 	signal.Notify(gracefulShutdown, syscall.SIGTERM, syscall.SIGINT)
 
-	dockerRunner := NewDockerRunner(*dockerDaemonDebug, *mtu, *registryMirror)
+	// cancelled on shutdown to abort waiting, sleeping and in-flight pulls
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-gracefulShutdown
+		log.Info().Msg("Shutting down...")
+		cancel()
+	}()
 
-	err := dockerRunner.startDockerDaemon()
+	var dockerRunner DockerRunner
+	switch *runner {
+	case "skopeo":
+		dockerRunner, err = newSkopeoRunner(jitter, skopeoRunnerConfig{
+			destination:           *skopeoDestination,
+			insecureRegistries:    splitCommaSeparated(*insecureRegistries),
+			pullMaxRetries:        *pullMaxRetries,
+			retryRateLimitedPulls: *rateLimitCooldown == 0,
+			pullTimeoutSeconds:    *pullTimeoutSeconds,
+			quietPulls:            *quietPulls,
+			pullPriority:          pullPriority,
+			dryRun:                *dryRun,
+		})
+	case "nerdctl":
+		dockerRunner, err = newNerdctlRunner(jitter, nerdctlRunnerConfig{
+			address:               *containerdAddress,
+			namespace:             *containerdNamespace,
+			startupTimeout:        time.Duration(*daemonStartupTimeout) * time.Second,
+			insecureRegistries:    splitCommaSeparated(*insecureRegistries),
+			pullMaxRetries:        *pullMaxRetries,
+			retryRateLimitedPulls: *rateLimitCooldown == 0,
+			pullTimeoutSeconds:    *pullTimeoutSeconds,
+			quietPulls:            *quietPulls,
+			pullPriority:          pullPriority,
+			dryRun:                *dryRun,
+		})
+	default:
+		dockerRunner, err = NewDockerRunner(jitter, dockerRunnerConfig{
+			manageDaemon:              *manageDaemon,
+			dockerHosts:               getDockerHosts(splitCommaSeparated(*dockerHosts), *enableTCPHost),
+			debug:                     *dockerDaemonDebug,
+			mtu:                       *mtu,
+			registryMirrors:           splitCommaSeparated(*registryMirrors),
+			registryMirrorCredentials: registryMirrorCredentials,
+			storageDriver:             *storageDriver,
+			dataRoot:                  *dockerDataRoot,
+			maxConcurrentDownloads:    *daemonMaxDownloads,
+			insecureRegistries:        splitCommaSeparated(*insecureRegistries),
+			daemonArgs:                *daemonArgs,
+			daemonConfigFile:          *daemonConfigFile,
+			daemonConfigJSON:          *daemonConfigJSON,
+			daemonMaxRestarts:         *daemonMaxRestarts,
+			daemonStderrLines:         *daemonStderrLines,
+			daemonStartupTimeout:      time.Duration(*daemonStartupTimeout) * time.Second,
+			pullMaxRetries:            *pullMaxRetries,
+			retryRateLimitedPulls:     *rateLimitCooldown == 0,
+			pullTimeoutSeconds:        *pullTimeoutSeconds,
+			pullProgress:              *pullProgress,
+			quietPulls:                *quietPulls,
+			pullPriority:              pullPriority,
+			contentTrust:              *contentTrust,
+			pruneVolumes:              *pruneVolumes,
+			pruneBuildCache:           *pruneBuildCache,
+			dryRun:                    *dryRun,
+		})
+	}
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed starting docker daemon")
+		log.Fatal().Err(err).Msgf("Failed creating %v runner", *runner)
 	}
+	if *auditLogPath != "" {
+		dockerRunner = newAuditingDockerRunner(dockerRunner, newAuditLog(*auditLogPath, *dryRun))
+	}
+	healthChecker := newHealthChecker(dockerRunner)
+	status := newHeaterStatus()
+	prometheus.MustRegister(newImageAgeCollector(status))
 
-	dockerRunner.waitForDockerDaemon()
+	heater := newHeater(dockerRunner, healthChecker, status, jitter, heaterConfig{
+		containerListFilePath:            *containerListFilePath,
+		containerListFetchTimeoutSeconds: *containerListTimeout,
+		containerListRetrySeconds:        *containerListRetry,
+		valuesFile:                       *valuesFile,
+		heatIntervalSeconds:              *heatIntervalSeconds,
+		maxConcurrentPulls:               *maxConcurrentPulls,
+		defaultPlatform:                  *defaultPlatform,
+		disablePrune:                     *disablePrune,
+		pruneByDigest:                    *pruneByDigest,
+		pruneDanglingOnly:                *pruneDanglingOnly,
+		pruneKeep:                        *pruneKeep,
+		pruneKeepPulled:                  *pruneKeepPulled,
+		pruneDiskThresholdPercent:        *pruneDiskThreshold,
+		dockerDataRoot:                   getDockerDataRoot(*dockerDataRoot),
+		insecureRegistries:               splitCommaSeparated(*insecureRegistries),
+		discoveryRegistry:                *discoveryRegistry,
+		discoveryTagsPerRepo:             *discoveryTagsPerRepo,
+		discoveryRepoFilter:              *discoveryRepoFilter,
+		discoveryMaxImageAgeDays:         *maxImageAgeDays,
+		dryRun:                           *dryRun,
+		requireNonEmptyList:              *requireNonEmptyList,
+		maxCacheBytes:                    *maxCacheBytes,
+		imageInclude:                     *imageInclude,
+		imageExclude:                     *imageExclude,
+		staggerPulls:                     *staggerPulls,
+		sequential:                       *sequential,
+		registryConcurrency:              registryConcurrencyLimits,
+		keepTagsPerRepo:                  *keepTagsPerRepo,
+		kubernetesNamespaces:             splitCommaSeparated(*kubernetesNamespaces),
+		rateLimitCooldown:                time.Duration(*rateLimitCooldown) * time.Minute,
+		failureBackoffMaxIntervals:       *failureBackoffMax,
+		dockerConfigPath:                 *dockerConfigPath,
+		postPruneCooldownSeconds:         *postPruneCooldown,
+		pruneEveryNCycles:                *pruneEveryNCycles,
+		skipPruneOnFailure:               *skipPruneOnFailure,
+		skipPruneFailureRatio:            *skipPruneFailureRatio,
+		imageTarballDir:                  *imageTarballDir,
+		startedAt:                        startedAt,
+	})
 
-	// wait for health endpoint to be ready
-	if *registryHealthEndpoint != "" {
-		for {
-			log.Info().Msgf("Waiting for registry health endpoint at %v to be ready", *registryHealthEndpoint)
-			resp, err := http.Get(*registryHealthEndpoint)
-			if err == nil && resp.StatusCode == http.StatusOK {
-				log.Info().Msg("Registry is ready")
-				break
+	// log what a heating cycle would pull and prune and exit, before starting the docker daemon, serving any endpoints or
+	// sending metrics and events
+	if *dryRun {
+		start := time.Now()
+		result, err := heater.runCycle(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			exit(exitCodeConfigInvalid, err, "Failed running heating cycle")
+		}
+		result.logSummary(time.Since(start))
+		return
+	}
+
+	// send the metrics to statsd as well
+	if *statsdAddress != "" {
+		statsd, err = newStatsdClient(*statsdAddress)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed creating statsd client")
+		}
+	}
+
+	// publish the pull results for a real-time view of the cache across the fleet
+	if *natsURL != "" {
+		pullEvents, err = newNatsPublisher(*natsURL, *natsSubject)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed creating nats publisher")
+		}
+	}
+
+	// serve prometheus metrics and health endpoints
+	server := newHTTPServer()
+	server.handle(*metricsListenAddress, "/metrics", promhttp.Handler())
+	server.handleFunc(*healthListenAddress, "/liveness", healthChecker.livenessHandler)
+	server.handleFunc(*healthListenAddress, "/readiness", healthChecker.readinessHandler)
+	server.handleFunc(*healthListenAddress, "/config", status.configHandler)
+	server.start()
+
+	err = startDockerDaemonWithRetries(ctx, dockerRunner, *daemonStartRetries)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		exit(exitCodeDaemonStartFailed, err, "Failed starting docker daemon")
+	}
+
+	// restart the docker daemon if it crashes
+	go dockerRunner.superviseDockerDaemon(ctx)
+
+	// wait for health endpoints to be ready
+	if endpoints := splitCommaSeparated(*registryHealthEndpoints); len(endpoints) > 0 {
+		registryHealth, err := newRegistryHealthChecker(jitter, registryHealthConfig{
+			endpoints:             endpoints,
+			timeout:               time.Duration(*registryHealthTimeout) * time.Second,
+			headers:               *registryHealthHeaders,
+			caCertPath:            *registryHealthCACert,
+			insecureSkipTLSVerify: *registryHealthInsecure,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed creating registry health checker")
+		}
+
+		err = registryHealth.wait(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if *registryHealthRequired {
+				exit(exitCodeRegistryHealthTimeout, err, "Registry is not ready")
 			}
-			sleepWithJitter(10)
+			log.Warn().Err(err).Msg("Registry is not ready, continuing anyway")
 		}
 	}
 
+	// let pipelines warm an image right after pushing it; the health server is already running, so the endpoint is only
+	// served once the docker daemon is ready
+	server.handleFunc(*healthListenAddress, "/pull", newPullTrigger(heater, *pullTriggerSecret).pullHandler)
+
+	completionWebhook := newCompletionWebhook(*completionWebhookURL)
+	slackNotifier := newSlackNotifier(*slackWebhookURL, *slackFailureThreshold)
+
+	// spread the first heating cycle of many heaters over time
+	if *startupJitterSeconds > 0 {
+		sleepUntil(ctx, time.Duration(jitter.upTo(*startupJitterSeconds))*time.Second, nil, nil)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+
+	// start with fewer parallel pulls on a cold node and ramp up once the common layers are cached
+	concurrentPulls := *maxConcurrentPulls
+	if *initialConcurrentPulls > 0 {
+		concurrentPulls = *initialConcurrentPulls
+	}
+	heater.setConcurrentPulls(concurrentPulls)
+
+	// pull everything once and exit, for running as a job
+	if *runOnce {
+		start := time.Now()
+		result, err := heater.runCycle(ctx)
+		completionWebhook.notify(result, time.Since(start), err)
+		if ctx.Err() != nil {
+			exit(exitCodeFailed, err, "Stopped heating cycle before it completed")
+		}
+		if err != nil {
+			// the cycle only fails as a whole when the container list can't be read
+			exit(exitCodeConfigInvalid, err, "Failed running heating cycle")
+		}
+		result.logSummary(time.Since(start))
+		if len(result.failedPulls) > 0 {
+			exitCode := exitCodeFailed
+			if len(result.pulledImages) == 0 {
+				exitCode = exitCodeAllPullsFailed
+			}
+			exit(exitCode, nil, "Failed pulling %v container image(s)", len(result.failedPulls))
+		}
+		return
+	}
+
+	// reload the container list as soon as it changes instead of waiting for the next cycle
+	var containerListChanges <-chan struct{}
+	if *containerListFilePath != "" && !isURL(*containerListFilePath) {
+		containerListChanges, err = watchContainerList(*containerListFilePath)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed watching %v for changes, changes are picked up in the next cycle", *containerListFilePath)
+		}
+	}
+
+	// let operators and integration tests start a heating cycle without waiting for the sleep to elapse
+	refreshTrigger := newRefreshTrigger()
+	server.handleFunc(*healthListenAddress, "/refresh", refreshTrigger.refreshHandler)
+
+	// restart with a fresh docker daemon once in a while, since the daemon accumulates state and memory over days
+	var restartAt time.Time
+	if *maxLifetimeHours > 0 {
+		// spread the restarts of heaters started at the same time
+		restartAt = startedAt.Add(time.Duration(jitter.apply(*maxLifetimeHours*3600)) * time.Second)
+		log.Info().Msgf("Shutting down to restart with a fresh docker daemon at %v, after the max lifetime of %v hours", restartAt.Format(time.RFC3339), *maxLifetimeHours)
+	}
+
+	heaterDone := make(chan struct{})
 	go func() {
+		defer close(heaterDone)
+
 		// loop indefinitely
 		for {
-			// get list of containers to preheat
-			log.Info().Msgf("Reading %v file...", *containerListFilePath)
-
-			data, err := ioutil.ReadFile(*containerListFilePath)
-			if err != nil {
-				log.Warn().Err(err).Msgf("Failed reading file %v", *containerListFilePath)
-				sleepWithJitter(900)
-				continue
+			start := time.Now()
+			refreshTrigger.started()
+			result, err := heater.runCycle(ctx)
+			refreshTrigger.completed(result, time.Since(start), err)
+			if ctx.Err() != nil {
+				return
 			}
+			completionWebhook.notify(result, time.Since(start), err)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed running heating cycle")
+			} else {
+				result.logSummary(time.Since(start))
+				slackNotifier.observe(result)
 
-			// unmarshal strict, so non-defined properties or incorrect nesting will fail
-			var containerList ContainerList
-			if err := yaml.UnmarshalStrict(data, &containerList); err != nil {
-				log.Warn().Err(err).Msgf("Failed unmarshaling file %v", *containerListFilePath)
-				sleepWithJitter(900)
-				continue
+				if concurrentPulls < *maxConcurrentPulls {
+					concurrentPulls = rampConcurrentPulls(concurrentPulls, *concurrentPullsStep, *maxConcurrentPulls)
+					heater.setConcurrentPulls(concurrentPulls)
+				}
 			}
 
-			var wg sync.WaitGroup
-
-			// pull all images in parallel
-			wg.Add(len(containerList.Containers))
-			for _, c := range containerList.Containers {
-				go func(container string) {
-					defer wg.Done()
-					dockerRunner.runDockerPull(container)
-				}(c)
+			sleepTime := heater.nextCycleIn()
+			if untilRestart := time.Until(restartAt); !restartAt.IsZero() && untilRestart < sleepTime {
+				sleepTime = 0
+				if untilRestart > 0 {
+					sleepTime = untilRestart
+				}
+				log.Info().Msgf("Reaching the max lifetime of %v hours in %v seconds, shutting down then", *maxLifetimeHours, int(sleepTime.Seconds()))
 			}
-			// wait for all pulls to finish
-			wg.Wait()
 
-			// prune all containers, images, volumes, etc
-			dockerRunner.runDockerSystemPrune()
+			if sleepUntil(ctx, sleepTime, containerListChanges, refreshTrigger.wake) {
+				log.Info().Msgf("Reloading %v after it changed...", *containerListFilePath)
+			}
 
-			sleepWithJitter(900)
+			// only shut down between cycles, so the last cycle completes
+			if !restartAt.IsZero() && !time.Now().Before(restartAt) && ctx.Err() == nil {
+				log.Info().Msgf("Reached the max lifetime of %v hours, shutting down so the pod restarts with a fresh docker daemon", *maxLifetimeHours)
+				cancel()
+				return
+			}
 		}
 	}()
 
 	// block until SIGTERM
-	<-gracefulShutdown
-	log.Info().Msg("Shutting down...")
+	<-ctx.Done()
+
+	// give in-flight pulls time to wind down
+	select {
+	case <-heaterDone:
+		log.Info().Msg("Stopped heating")
+	case <-time.After(time.Duration(*shutdownGracePeriod) * time.Second):
+		log.Warn().Msgf("In-flight pulls didn't stop within %v seconds", *shutdownGracePeriod)
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	server.shutdown(shutdownCtx)
 }
 
-func sleepWithJitter(input int) {
-	sleepTime := applyJitter(input)
-	log.Info().Msgf("Sleeping for %v seconds...", sleepTime)
-	time.Sleep(time.Duration(sleepTime) * time.Second)
+// sleepUntil sleeps for the duration, but wakes up early when wake or refresh receives or the context is cancelled; it
+// returns whether it woke up early because of wake
+func sleepUntil(ctx context.Context, sleepTime time.Duration, wake, refresh <-chan struct{}) bool {
+	log.Info().Msgf("Sleeping for %v seconds...", int(sleepTime.Seconds()))
+
+	select {
+	case <-time.After(sleepTime):
+		return false
+	case <-ctx.Done():
+		return false
+	case <-wake:
+		return true
+	case <-refresh:
+		return false
+	}
 }
 
-func applyJitter(input int) (output int) {
+// getDockerHosts returns the addresses for the started docker daemon to listen on, adding the unauthenticated tcp
+// address only when enabled explicitly
+func getDockerHosts(dockerHosts []string, enableTCPHost bool) []string {
+	if !enableTCPHost {
+		return dockerHosts
+	}
+	for _, dockerHost := range dockerHosts {
+		if dockerHost == tcpDockerHost {
+			return dockerHosts
+		}
+	}
+	return append(dockerHosts, tcpDockerHost)
+}
 
-	deviation := int(0.25 * float64(input))
+// getDockerDataRoot returns the directory the docker daemon stores its images in
+func getDockerDataRoot(dataRoot string) string {
+	if dataRoot == "" {
+		return defaultDockerDataRoot
+	}
+	return dataRoot
+}
 
-	return input - deviation + r.Intn(2*deviation)
+// rampConcurrentPulls returns the number of parallel pulls for the next heating cycle
+func rampConcurrentPulls(concurrentPulls, step, maxConcurrentPulls int) int {
+	if concurrentPulls+step > maxConcurrentPulls {
+		return maxConcurrentPulls
+	}
+	return concurrentPulls + step
 }
 
-func runCommandExtended(command string, args []string) error {
-	log.Printf("Running command '%v %v'...", command, strings.Join(args, " "))
-	cmd := exec.Command(command, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	return err
+// splitCommaSeparated allows repeatable flags to be set as a comma-separated list as well, which is easier to set in an
+// environment variable
+func splitCommaSeparated(values []string) (splitValues []string) {
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				splitValues = append(splitValues, v)
+			}
+		}
+	}
+	return
 }
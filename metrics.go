@@ -0,0 +1,153 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pullTotals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "estafette_docker_cache_heater_pull_totals",
+			Help: "Number of pulled container images by result.",
+		},
+		[]string{"image", "result"},
+	)
+
+	pullDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "estafette_docker_cache_heater_pull_duration_seconds",
+			Help:    "Duration of pulling a container image, including retries.",
+			Buckets: []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200},
+		},
+		[]string{"image"},
+	)
+
+	containerListImages = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "estafette_docker_cache_heater_container_list_images",
+			Help: "Number of container images in the current container list.",
+		},
+	)
+
+	failedPulls = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "estafette_docker_cache_heater_failed_pulls",
+			Help: "Number of container images that failed to pull in the last heating cycle.",
+		},
+	)
+
+	cachedImagesBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "estafette_docker_cache_heater_cached_images_bytes",
+			Help: "Total size of the container images in the current container list as of their last pull, counting shared layers for each image.",
+		},
+	)
+
+	rateLimitedPullTotals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "estafette_docker_cache_heater_rate_limited_pull_totals",
+			Help: "Number of pulls rate limited by the registry.",
+		},
+		[]string{"registry"},
+	)
+
+	timeToWarmSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "estafette_docker_cache_heater_time_to_warm_seconds",
+			Help: "Number of seconds from the start of the heater until all container images in the container list were pulled in a heating cycle without failures.",
+		},
+	)
+
+	pruneTotals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "estafette_docker_cache_heater_prune_totals",
+			Help: "Number of docker system prune runs by result.",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(pullTotals)
+	prometheus.MustRegister(pullDurationSeconds)
+	prometheus.MustRegister(containerListImages)
+	prometheus.MustRegister(failedPulls)
+	prometheus.MustRegister(cachedImagesBytes)
+	prometheus.MustRegister(rateLimitedPullTotals)
+	prometheus.MustRegister(timeToWarmSeconds)
+	prometheus.MustRegister(pruneTotals)
+}
+
+// imageAgeCollector reports the number of seconds since the last successful pull of each image at the time of the
+// scrape, to tell a stale cache from one that's still being refreshed
+type imageAgeCollector struct {
+	status *heaterStatus
+	desc   *prometheus.Desc
+}
+
+func newImageAgeCollector(status *heaterStatus) *imageAgeCollector {
+	return &imageAgeCollector{
+		status: status,
+		desc: prometheus.NewDesc(
+			"estafette_docker_cache_heater_image_age_seconds",
+			"Number of seconds since the last successful pull of a container image in the container list.",
+			[]string{"image", "platform"},
+			nil,
+		),
+	}
+}
+
+func (c *imageAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *imageAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, lastPull := range c.status.getLastPulls() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(lastPull.PulledAt).Seconds(), lastPull.Image, lastPull.Platform)
+	}
+}
+
+func observePull(container Container, duration time.Duration, downloadedBytes int64, err error) {
+	pullTotals.WithLabelValues(container.Image, getResultLabel(err)).Inc()
+	pullDurationSeconds.WithLabelValues(container.Image).Observe(duration.Seconds())
+
+	imageTag := "image:" + container.Image
+	statsd.increment("pull_totals", imageTag, "result:"+getResultLabel(err))
+	statsd.timing("pull_duration", duration, imageTag)
+	statsd.count("pull_downloaded_bytes", downloadedBytes, imageTag)
+
+	pullEvents.publishPull(container, duration, downloadedBytes, err)
+}
+
+func observeRateLimitedPull(registry string) {
+	rateLimitedPullTotals.WithLabelValues(registry).Inc()
+
+	statsd.increment("rate_limited_pull_totals", "registry:"+registry)
+}
+
+func observeTimeToWarm(timeToWarm time.Duration) {
+	timeToWarmSeconds.Set(timeToWarm.Seconds())
+
+	statsd.timing("time_to_warm", timeToWarm)
+}
+
+func observePrune(err error) {
+	pruneTotals.WithLabelValues(getResultLabel(err)).Inc()
+
+	statsd.increment("prune_totals", "result:"+getResultLabel(err))
+}
+
+func getResultLabel(err error) string {
+	if _, ok := err.(untrustedImageError); ok {
+		return "untrusted"
+	}
+	if _, ok := err.(rateLimitedError); ok {
+		return "rate_limited"
+	}
+	if err != nil {
+		return "failed"
+	}
+	return "succeeded"
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	natsTimeout = 5 * time.Second
+	// the number of events buffered while the connection is slow or down, newer events are dropped beyond that
+	natsBufferSize = 1000
+)
+
+// pullEvents publishes an event for each pull to nats if --nats-url is set, nil otherwise
+var pullEvents *natsPublisher
+
+// pullEvent is the json payload published for each pull, to follow the state of the cache across a fleet of heaters
+type pullEvent struct {
+	Node            string    `json:"node"`
+	Timestamp       time.Time `json:"timestamp"`
+	Image           string    `json:"image"`
+	Platform        string    `json:"platform,omitempty"`
+	Result          string    `json:"result"`
+	Error           string    `json:"error,omitempty"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	DownloadedBytes int64     `json:"downloadedBytes"`
+}
+
+// natsPublisher publishes messages to a nats subject; messages are sent from a buffer in the background, so a slow or
+// unavailable nats server never holds up the pulls
+type natsPublisher struct {
+	url      string
+	host     string
+	subject  string
+	hostname string
+	messages chan []byte
+	conn     *nats.Conn
+}
+
+func newNatsPublisher(natsURL, subject string) (*natsPublisher, error) {
+
+	u, err := url.Parse(natsURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing nats url %v: %v", natsURL, err)
+	}
+	if (u.Scheme != "nats" && u.Scheme != "tls") || u.Hostname() == "" {
+		return nil, fmt.Errorf("Nats url is not of the form nats://[user:password@]host[:port] or tls://[user:password@]host[:port]")
+	}
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return nil, fmt.Errorf("Nats subject %q is empty or contains whitespace", subject)
+	}
+
+	hostname, _ := os.Hostname()
+
+	np := &natsPublisher{
+		url:      natsURL,
+		host:     u.Host,
+		subject:  subject,
+		hostname: hostname,
+		messages: make(chan []byte, natsBufferSize),
+	}
+	go np.run()
+
+	return np, nil
+}
+
+// publishPull queues an event for the pull; failures are only logged, since they shouldn't affect heating
+func (np *natsPublisher) publishPull(container Container, duration time.Duration, downloadedBytes int64, err error) {
+	if np == nil {
+		return
+	}
+
+	event := pullEvent{
+		Node:            np.hostname,
+		Timestamp:       time.Now().UTC(),
+		Image:           container.Image,
+		Platform:        container.Platform,
+		Result:          getResultLabel(err),
+		DurationSeconds: duration.Seconds(),
+		DownloadedBytes: downloadedBytes,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed marshaling pull event")
+		return
+	}
+
+	select {
+	case np.messages <- data:
+	default:
+		log.Debug().Msgf("Dropped pull event for image '%v', the nats buffer is full", container.Image)
+	}
+}
+
+// run publishes the buffered messages, connecting once the first message is published; the client reconnects by
+// itself after the connection fails
+func (np *natsPublisher) run() {
+	for data := range np.messages {
+		if err := np.publish(data); err != nil {
+			log.Warn().Err(err).Msgf("Failed publishing to nats subject %v", np.subject)
+		}
+	}
+}
+
+func (np *natsPublisher) publish(data []byte) error {
+
+	if np.conn == nil || np.conn.IsClosed() {
+		conn, err := np.connect()
+		if err != nil {
+			return err
+		}
+		np.conn = conn
+	}
+
+	return np.conn.Publish(np.subject, data)
+}
+
+func (np *natsPublisher) connect() (*nats.Conn, error) {
+
+	conn, err := nats.Connect(np.url,
+		nats.Name(app),
+		nats.Timeout(natsTimeout),
+		// keep reconnecting, messages published in the meantime are buffered by the client
+		nats.MaxReconnects(-1),
+		nats.DisconnectHandler(func(conn *nats.Conn) {
+			log.Warn().Msgf("Disconnected from nats at %v", np.host)
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			log.Info().Msgf("Reconnected to nats at %v", np.host)
+		}),
+		nats.ErrorHandler(func(conn *nats.Conn, subscription *nats.Subscription, err error) {
+			log.Warn().Err(err).Msgf("Nats at %v returned an error", np.host)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Failed connecting to nats at %v: %v", np.host, err)
+	}
+
+	log.Info().Msgf("Connected to nats at %v", np.host)
+
+	return conn, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNatsServer speaks just enough of the nats protocol to accept a client connection and receive its messages
+type fakeNatsServer struct {
+	listener net.Listener
+	connects chan map[string]interface{}
+	messages chan fakeNatsMessage
+}
+
+type fakeNatsMessage struct {
+	subject string
+	data    []byte
+}
+
+func newFakeNatsServer(t *testing.T) *fakeNatsServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed listening: %v", err)
+	}
+
+	server := &fakeNatsServer{
+		listener: listener,
+		connects: make(chan map[string]interface{}, 10),
+		messages: make(chan fakeNatsMessage, 10),
+	}
+	go server.serve()
+
+	return server
+}
+
+func (s *fakeNatsServer) url() string {
+	return "nats://" + s.listener.Addr().String()
+}
+
+func (s *fakeNatsServer) close() {
+	s.listener.Close()
+}
+
+func (s *fakeNatsServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeNatsServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"version\":\"1.4.0\",\"go\":\"go1.12\",\"host\":%q,\"port\":%v,\"max_payload\":1048576}\r\n", host, port)
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, "CONNECT "):
+			var options map[string]interface{}
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "CONNECT ")), &options)
+			s.connects <- options
+
+		case line == "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+
+		case strings.HasPrefix(line, "PUB "):
+			// PUB <subject> [reply-to] <size>
+			fields := strings.Fields(line)
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return
+			}
+			s.messages <- fakeNatsMessage{subject: fields[1], data: data[:size]}
+		}
+	}
+}
+
+func TestNatsPublisher(t *testing.T) {
+
+	t.Run("PublishesPullEventToSubject", func(t *testing.T) {
+		server := newFakeNatsServer(t)
+		defer server.close()
+
+		np, err := newNatsPublisher(server.url(), "cache-heater.pulls")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		np.publishPull(Container{Image: "nginx:1.17", Platform: "linux/arm64"}, 2*time.Second, 1024, fmt.Errorf("manifest unknown"))
+
+		select {
+		case message := <-server.messages:
+			if message.subject != "cache-heater.pulls" {
+				t.Errorf("Expected subject cache-heater.pulls, got %v", message.subject)
+			}
+			var event pullEvent
+			if err := json.Unmarshal(message.data, &event); err != nil {
+				t.Fatalf("Failed unmarshaling event %s: %v", message.data, err)
+			}
+			if event.Image != "nginx:1.17" || event.Platform != "linux/arm64" || event.Result != "failed" || event.Error != "manifest unknown" || event.DurationSeconds != 2 || event.DownloadedBytes != 1024 {
+				t.Errorf("Unexpected event %+v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a message to be published")
+		}
+	})
+
+	t.Run("ConnectsWithCredentialsInUrl", func(t *testing.T) {
+		server := newFakeNatsServer(t)
+		defer server.close()
+
+		np, err := newNatsPublisher(strings.Replace(server.url(), "nats://", "nats://heater:secret@", 1), "cache-heater.pulls")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		np.publishPull(Container{Image: "nginx:1.17"}, time.Second, 0, nil)
+
+		select {
+		case options := <-server.connects:
+			if options["user"] != "heater" || options["pass"] != "secret" || options["name"] != app {
+				t.Errorf("Unexpected connect options %v", options)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the publisher to connect")
+		}
+	})
+
+	t.Run("RejectsInvalidUrlOrSubject", func(t *testing.T) {
+		for _, c := range []struct{ url, subject string }{
+			{"http://nats.example.com:4222", "cache-heater.pulls"},
+			{"nats://", "cache-heater.pulls"},
+			{"nats://nats.example.com:4222", ""},
+			{"nats://nats.example.com:4222", "cache heater"},
+		} {
+			if _, err := newNatsPublisher(c.url, c.subject); err == nil {
+				t.Errorf("Expected an error for url %v and subject %q", c.url, c.subject)
+			}
+		}
+	})
+
+	t.Run("IgnoresPullsWithoutNatsUrl", func(t *testing.T) {
+		var np *natsPublisher
+
+		np.publishPull(Container{Image: "nginx:1.17"}, time.Second, 0, nil)
+	})
+}
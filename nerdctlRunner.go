@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// the containerd namespace the kubelet pulls into and keeps its image cache in
+const kubeletNamespace = "k8s.io"
+
+// nerdctlRunnerConfig holds the settings for pulling images into containerd with nerdctl
+type nerdctlRunnerConfig struct {
+	// the socket of the containerd running on the host
+	address string
+	// the containerd namespace to pull into, k8s.io for the images used by kubernetes
+	namespace          string
+	insecureRegistries []string
+	// how long to wait for containerd to be ready before giving up
+	startupTimeout time.Duration
+	pullMaxRetries int
+	// retry pulls the registry rate limited, when the heater doesn't skip the registry for a cooldown instead
+	retryRateLimitedPulls bool
+	pullTimeoutSeconds    int
+	quietPulls            bool
+	pullPriority          pullPriority
+	// log the nerdctl commands equivalent to the pulls and prunes instead of running them
+	dryRun bool
+}
+
+// nerdctlRunner implements DockerRunner by pulling images into the content store of the host's containerd with nerdctl
+type nerdctlRunner struct {
+	nerdctlRunnerConfig
+
+	jitter *jitter
+
+	// creates the nerdctl processes, exec.CommandContext unless replaced to avoid running nerdctl
+	execCommand func(ctx context.Context, name string, arg ...string) *exec.Cmd
+
+	registryLogins *registryLogins
+}
+
+// newNerdctlRunner returns a DockerRunner using nerdctl
+func newNerdctlRunner(jitter *jitter, config nerdctlRunnerConfig) (DockerRunner, error) {
+
+	if config.address == "" || config.namespace == "" {
+		return nil, fmt.Errorf("The containerd address and namespace are needed for the nerdctl runner")
+	}
+
+	return &nerdctlRunner{
+		nerdctlRunnerConfig: config,
+
+		jitter:      jitter,
+		execCommand: exec.CommandContext,
+
+		registryLogins: newRegistryLogins(),
+	}, nil
+}
+
+// startDockerDaemon does nothing, since containerd is already running on the host
+func (nr *nerdctlRunner) startDockerDaemon() error {
+	log.Info().Msgf("Using containerd at %v in namespace %v", nr.address, nr.namespace)
+	return nil
+}
+
+func (nr *nerdctlRunner) waitForDockerDaemon(ctx context.Context) error {
+
+	// the published image doesn't include nerdctl, so fail right away instead of waiting for containerd
+	if _, err := exec.LookPath("nerdctl"); err != nil {
+		return fmt.Errorf("Failed finding nerdctl, which isn't part of the published image: %v", err)
+	}
+
+	log.Debug().Msg("Waiting for containerd to be ready for use...")
+
+	timeout := time.After(nr.startupTimeout)
+	pollInterval := minDaemonPollInterval
+	for !nr.isDockerDaemonReady(ctx) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return fmt.Errorf("Containerd at %v wasn't ready within %v", nr.address, nr.startupTimeout)
+		case <-time.After(pollInterval):
+		}
+		pollInterval = getNextDaemonPollInterval(pollInterval)
+	}
+
+	log.Debug().Msg("Containerd is ready for use")
+
+	return nil
+}
+
+// superviseDockerDaemon does nothing, containerd is supervised by the host
+func (nr *nerdctlRunner) superviseDockerDaemon(ctx context.Context) {
+}
+
+func (nr *nerdctlRunner) isDockerDaemonReady(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := runCommand(nr.command(ctx, "version"))
+	return err == nil
+}
+
+func (nr *nerdctlRunner) runDockerLogin(ctx context.Context, credentials RegistryCredentials) (err error) {
+
+	// there's nothing to log in with, a docker config file is passed to nerdctl pull directly
+	if credentials.Username == "" || credentials.DockerConfigPath != "" {
+		return
+	}
+
+	return nr.registryLogins.login(credentials, func(registry string) error {
+		// pass the password on stdin, so it doesn't show up in the process list
+		cmd := nr.command(ctx, "login", "--username", credentials.Username, "--password-stdin", getServerAddress(registry))
+		cmd.Stdin = strings.NewReader(credentials.Password)
+		_, err := runCommand(cmd)
+		return err
+	})
+}
+
+func (nr *nerdctlRunner) runDockerPull(ctx context.Context, container Container, credentials *RegistryCredentials) (downloadedBytes int64, err error) {
+
+	args := []string{}
+	if isInsecureRegistry(nr.insecureRegistries, getImageRegistry(container.Image)) {
+		args = append(args, "--insecure-registry")
+	}
+	args = append(args, "pull", "--quiet")
+	if container.Platform != "" {
+		args = append(args, "--platform", container.Platform)
+	}
+	args = append(args, container.Image)
+
+	if nr.dryRun {
+		log.Info().Msgf("Dry run: nerdctl %v", strings.Join(nr.getArgs(args...), " "))
+		return
+	}
+
+	if credentials != nil {
+		err = nr.runDockerLogin(ctx, *credentials)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed pulling container image '%v'", container.Image)
+			return
+		}
+	}
+
+	return pullWithRetries(ctx, nr.jitter, container, nr.pullMaxRetries, nr.retryRateLimitedPulls, nr.quietPulls, func(ctx context.Context) (int64, error) {
+		// cancel the pull once it exceeds the timeout, so a hanging pull doesn't block the heating cycle
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(nr.pullTimeoutSeconds)*time.Second)
+		defer cancel()
+
+		name, priorityArgs := nr.pullPriority.wrap("nerdctl", nr.getArgs(args...)...)
+		cmd := nr.execCommand(ctx, name, priorityArgs...)
+		if credentials != nil && credentials.DockerConfigPath != "" {
+			// nerdctl reads the credentials from the config.json file in the DOCKER_CONFIG directory
+			cmd.Env = append(os.Environ(), fmt.Sprintf("DOCKER_CONFIG=%v", filepath.Dir(credentials.DockerConfigPath)))
+		}
+
+		// nerdctl doesn't report the number of downloaded bytes
+		_, err := runCommand(cmd)
+		return 0, err
+	})
+}
+
+func (nr *nerdctlRunner) runDockerLoad(ctx context.Context, containerImage, tarballPath string) (err error) {
+
+	if nr.dryRun {
+		log.Info().Msgf("Dry run: nerdctl %v", strings.Join(nr.getArgs("load", "--input", tarballPath), " "))
+		return
+	}
+
+	log.Info().Msgf("Loading docker image '%v' from %v", containerImage, tarballPath)
+
+	_, err = runCommand(nr.command(ctx, "load", "--input", tarballPath))
+
+	return
+}
+
+func (nr *nerdctlRunner) runDockerRemoveImage(ctx context.Context, containerImage string) (err error) {
+
+	if nr.dryRun {
+		log.Info().Msgf("Dry run: nerdctl %v", strings.Join(nr.getArgs("rmi", containerImage), " "))
+		return
+	}
+
+	log.Info().Msgf("Removing docker image '%v'", containerImage)
+
+	_, err = runCommand(nr.command(ctx, "rmi", containerImage))
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed removing container image '%v'", containerImage)
+	}
+
+	return
+}
+
+// nerdctlImageInspect is the part of the nerdctl image inspect output needed for the digest and size of an image
+type nerdctlImageInspect struct {
+	RepoDigests []string `json:"RepoDigests"`
+	Size        int64    `json:"Size"`
+}
+
+func (nr *nerdctlRunner) getImageDigests(ctx context.Context, containerImage string) (digests []string, err error) {
+
+	inspect, err := nr.inspect(ctx, containerImage)
+	if err != nil {
+		return
+	}
+
+	// repo digests are in the form repository@sha256:...
+	for _, repoDigest := range inspect.RepoDigests {
+		if i := strings.Index(repoDigest, "@"); i >= 0 {
+			digests = append(digests, repoDigest[i+1:])
+		}
+	}
+
+	return
+}
+
+func (nr *nerdctlRunner) getImageSize(ctx context.Context, containerImage string) (int64, error) {
+
+	inspect, err := nr.inspect(ctx, containerImage)
+	if err != nil {
+		return 0, err
+	}
+
+	return inspect.Size, nil
+}
+
+// nerdctlImage is a line of the nerdctl images output, with an entry for each tag of an image
+type nerdctlImage struct {
+	ID         string `json:"ID"`
+	Repository string `json:"Repository"`
+	Tag        string `json:"Tag"`
+	Digest     string `json:"Digest"`
+}
+
+func (nr *nerdctlRunner) listImages(ctx context.Context) (images []localImage, err error) {
+
+	output, err := runCommand(nr.command(ctx, "images", "--no-trunc", "--format", "{{json .}}"))
+	if err != nil {
+		return
+	}
+
+	// group the tags by image
+	indexes := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var image nerdctlImage
+		if err = json.Unmarshal([]byte(line), &image); err != nil {
+			return nil, fmt.Errorf("Failed unmarshaling nerdctl images output: %v", err)
+		}
+
+		i, ok := indexes[image.ID]
+		if !ok {
+			i = len(images)
+			indexes[image.ID] = i
+			images = append(images, localImage{ID: image.ID})
+		}
+		if image.Repository != "" && image.Repository != "<none>" {
+			if image.Tag != "" && image.Tag != "<none>" {
+				images[i].RepoTags = append(images[i].RepoTags, image.Repository+":"+image.Tag)
+			}
+			if image.Digest != "" && image.Digest != "<none>" {
+				images[i].RepoDigests = append(images[i].RepoDigests, image.Repository+"@"+image.Digest)
+			}
+		}
+	}
+
+	return
+}
+
+// runDockerSystemPrune only prunes images, since the containers in the namespace are owned by kubernetes and must be
+// left alone; images in use by any container are skipped by the prune
+func (nr *nerdctlRunner) runDockerSystemPrune(ctx context.Context, keepImages []string) (err error) {
+
+	// pruning all unused images in the kubelet's namespace would wipe the node's image cache, and the containers that
+	// keep images would show up next to the kubelet's own, so only dangling images are pruned there
+	if nr.namespace == kubeletNamespace {
+		log.Debug().Msgf("Only pruning dangling images in the kubelet's containerd namespace %v", nr.namespace)
+		return nr.runDockerImagePrune(ctx)
+	}
+
+	if nr.dryRun {
+		log.Info().Strs("keepImages", keepImages).Msgf("Dry run: nerdctl %v", strings.Join(nr.getArgs("image", "prune", "--all", "--force"), " "))
+		return
+	}
+
+	nr.keepImages(ctx, keepImages)
+
+	log.Info().Msg("Pruning containerd images")
+
+	_, err = runCommand(nr.command(ctx, "image", "prune", "--all", "--force"))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed pruning images")
+		return
+	}
+
+	log.Info().Msg("Pruned containerd images")
+
+	return
+}
+
+func (nr *nerdctlRunner) runDockerImagePrune(ctx context.Context) (err error) {
+
+	if nr.dryRun {
+		log.Info().Msgf("Dry run: nerdctl %v", strings.Join(nr.getArgs("image", "prune", "--force"), " "))
+		return
+	}
+
+	log.Info().Msg("Pruning dangling containerd images")
+
+	_, err = runCommand(nr.command(ctx, "image", "prune", "--force"))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed pruning dangling images")
+		return
+	}
+
+	log.Info().Msg("Pruned dangling containerd images")
+
+	return
+}
+
+// keepImages protects images from pruning by creating a labeled container for each of them, like the docker runner
+func (nr *nerdctlRunner) keepImages(ctx context.Context, keepImages []string) {
+
+	// remove the containers for the previous set of images to keep, so images no longer kept are pruned
+	output, err := runCommand(nr.command(ctx, "ps", "--all", "--quiet", "--filter", fmt.Sprintf("label=%v", keepLabel)))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed listing containers for images to keep")
+	}
+	if containerIDs := strings.Fields(string(output)); len(containerIDs) > 0 {
+		_, err = runCommand(nr.command(ctx, append([]string{"rm", "--force"}, containerIDs...)...))
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed removing containers for images to keep")
+		}
+	}
+
+	for _, containerImage := range keepImages {
+		log.Info().Msgf("Keeping docker image '%v' when pruning", containerImage)
+
+		// the container is never started, so the command doesn't have to exist in the image
+		_, err := runCommand(nr.command(ctx, "create", "--label", keepLabel, containerImage, "keep"))
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed keeping container image '%v' when pruning", containerImage)
+		}
+	}
+}
+
+func (nr *nerdctlRunner) inspect(ctx context.Context, containerImage string) (inspect nerdctlImageInspect, err error) {
+
+	output, err := runCommand(nr.command(ctx, "image", "inspect", containerImage))
+	if err != nil {
+		return inspect, err
+	}
+
+	// nerdctl returns a list with an entry for each image matching the reference
+	var inspects []nerdctlImageInspect
+	if err = json.Unmarshal(output, &inspects); err != nil {
+		return inspect, fmt.Errorf("Failed unmarshaling nerdctl image inspect output for image %v: %v", containerImage, err)
+	}
+	if len(inspects) == 0 {
+		return inspect, fmt.Errorf("Image %v not found in containerd", containerImage)
+	}
+
+	return inspects[0], nil
+}
+
+// command returns a nerdctl command talking to the configured containerd and namespace
+func (nr *nerdctlRunner) command(ctx context.Context, arg ...string) *exec.Cmd {
+	return nr.execCommand(ctx, "nerdctl", nr.getArgs(arg...)...)
+}
+
+func (nr *nerdctlRunner) getArgs(arg ...string) []string {
+	return append([]string{fmt.Sprintf("--address=%v", nr.address), fmt.Sprintf("--namespace=%v", nr.namespace)}, arg...)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// validateProxy checks the proxy is an http, https or socks5 url, which both dockerd and go's http client accept
+func validateProxy(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Host == "" {
+		return fmt.Errorf("Proxy %v is not a url", proxy)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+		return nil
+	}
+
+	return fmt.Errorf("Proxy %v is not an http, https or socks5 url", proxy)
+}
+
+// setProxyEnvironment sets the proxy environment variables of the heater, which the docker daemon, docker cli, skopeo
+// and nerdctl processes inherit, and the heater's own requests to registries use as well
+func setProxyEnvironment(httpProxy, httpsProxy, noProxy string) {
+	for name, value := range map[string]string{"HTTP_PROXY": httpProxy, "HTTPS_PROXY": httpsProxy, "NO_PROXY": noProxy} {
+		if value == "" {
+			continue
+		}
+		// some tools only read the lowercase variables
+		os.Setenv(name, value)
+		os.Setenv(strings.ToLower(name), value)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+)
+
+var ioniceClasses = map[string]string{
+	"best-effort": "2",
+	"idle":        "3",
+}
+
+// pullPriority lowers the cpu and io priority of the processes doing the pulls, so heavy parallel pulls don't starve
+// the node's other workloads
+type pullPriority struct {
+	// the niceness of the processes, 0 to leave it unchanged; within the best-effort io class it lowers the io priority
+	// as well
+	nice int
+	// the io scheduling class, best-effort or idle, or empty to leave it unchanged
+	ioniceClass string
+}
+
+func validatePullPriority(pp pullPriority) error {
+	if pp.nice < 0 || pp.nice > 19 {
+		return fmt.Errorf("Pull niceness %v is not between 0 and 19", pp.nice)
+	}
+	if _, ok := ioniceClasses[pp.ioniceClass]; pp.ioniceClass != "" && !ok {
+		return fmt.Errorf("Pull ionice class %v is not best-effort or idle", pp.ioniceClass)
+	}
+	return nil
+}
+
+// isSet returns whether the priority of the processes is changed at all
+func (pp pullPriority) isSet() bool {
+	return pp.nice > 0 || pp.ioniceClass != ""
+}
+
+// wrap returns the command running the named command with the priority, by prefixing it with the nice and ionice
+// commands, so the priority is inherited by any process it spawns
+func (pp pullPriority) wrap(name string, arg ...string) (string, []string) {
+	if pp.ioniceClass != "" {
+		arg = append([]string{"-c", ioniceClasses[pp.ioniceClass], name}, arg...)
+		name = "ionice"
+	}
+	if pp.nice > 0 {
+		arg = append([]string{"-n", fmt.Sprint(pp.nice), name}, arg...)
+		name = "nice"
+	}
+	return name, arg
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/rs/zerolog/log"
+)
+
+// pullProgressLogger tracks the progress stream of a single pull, logging it as structured events
+type pullProgressLogger struct {
+	containerImage string
+	verbose        bool
+	// leave logging the pulled image to the caller
+	quiet bool
+
+	// the size of each layer downloaded, by layer id
+	layers map[string]int64
+	// the last logged status and percentage of each layer, to only log changes
+	lastStatus  map[string]string
+	lastPercent map[string]int64
+}
+
+func newPullProgressLogger(containerImage string, verbose, quiet bool) *pullProgressLogger {
+	return &pullProgressLogger{
+		containerImage: containerImage,
+		verbose:        verbose,
+		quiet:          quiet,
+		layers:         map[string]int64{},
+		lastStatus:     map[string]string{},
+		lastPercent:    map[string]int64{},
+	}
+}
+
+// read consumes the progress stream until the pull finishes and returns the number of bytes downloaded or the first
+// error reported in the stream
+func (pp *pullProgressLogger) read(reader io.Reader) (int64, error) {
+
+	start := time.Now()
+
+	decoder := json.NewDecoder(reader)
+	for {
+		var message jsonmessage.JSONMessage
+		if err := decoder.Decode(&message); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+
+		if message.Error != nil {
+			return 0, message.Error
+		}
+
+		pp.handle(message)
+	}
+
+	if pp.quiet {
+		return pp.downloadedBytes(), nil
+	}
+
+	log.Info().
+		Str("image", pp.containerImage).
+		Int("layers", len(pp.layers)).
+		Int64("downloadedBytes", pp.downloadedBytes()).
+		Float64("durationSeconds", time.Since(start).Seconds()).
+		Msgf("Pulled docker image '%v' in %v", pp.containerImage, time.Since(start).Round(time.Millisecond))
+
+	return pp.downloadedBytes(), nil
+}
+
+func (pp *pullProgressLogger) handle(message jsonmessage.JSONMessage) {
+
+	// messages without id are about the image as a whole, like the digest and final status
+	if message.ID == "" {
+		return
+	}
+
+	var current, total int64
+	if message.Progress != nil {
+		current = message.Progress.Current
+		total = message.Progress.Total
+	}
+
+	if message.Status == "Downloading" && total > 0 {
+		pp.layers[message.ID] = total
+	}
+
+	if !pp.verbose {
+		return
+	}
+
+	// log each status change, and download progress in steps of 10 percent
+	var percent int64
+	if total > 0 {
+		percent = current * 100 / total / 10 * 10
+	}
+	if message.Status == pp.lastStatus[message.ID] && percent == pp.lastPercent[message.ID] {
+		return
+	}
+	pp.lastStatus[message.ID] = message.Status
+	pp.lastPercent[message.ID] = percent
+
+	log.Info().
+		Str("image", pp.containerImage).
+		Str("layer", message.ID).
+		Str("status", message.Status).
+		Int64("currentBytes", current).
+		Int64("totalBytes", total).
+		Msgf("%v layer %v of docker image '%v'", message.Status, message.ID, pp.containerImage)
+}
+
+func (pp *pullProgressLogger) downloadedBytes() (downloadedBytes int64) {
+	for _, size := range pp.layers {
+		downloadedBytes += size
+	}
+	return
+}
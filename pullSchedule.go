@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// pullSchedule tracks when each container is due to be pulled again, so containers can be heated at their own interval
+type pullSchedule struct {
+	nextPulls map[string]time.Time
+	mutex     sync.Mutex
+	jitter    *jitter
+}
+
+func newPullSchedule(jitter *jitter) *pullSchedule {
+	return &pullSchedule{
+		jitter:    jitter,
+		nextPulls: map[string]time.Time{},
+	}
+}
+
+// isDue returns true for containers that haven't been pulled yet or whose interval has elapsed
+func (ps *pullSchedule) isDue(key string, now time.Time) bool {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	nextPull, ok := ps.nextPulls[key]
+	return !ok || !nextPull.After(now)
+}
+
+// schedule sets the next pull of a container after its interval, with jitter applied
+func (ps *pullSchedule) schedule(key string, intervalSeconds int, from time.Time) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.nextPulls[key] = from.Add(time.Duration(ps.jitter.apply(intervalSeconds)) * time.Second)
+}
+
+// postpone moves the next pull of a container to until, unless it's already due later
+func (ps *pullSchedule) postpone(key string, until time.Time) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if nextPull, ok := ps.nextPulls[key]; !ok || nextPull.Before(until) {
+		ps.nextPulls[key] = until
+	}
+}
+
+// getBackoffIntervals returns the number of intervals to wait before pulling an image again after its consecutive
+// failures, doubling with each failure from a single interval up to the maximum
+func getBackoffIntervals(consecutiveFailures, maxIntervals int) int {
+	intervals := 1
+	for i := 1; i < consecutiveFailures && intervals < maxIntervals; i++ {
+		intervals *= 2
+	}
+	if intervals > maxIntervals {
+		return maxIntervals
+	}
+	return intervals
+}
+
+// retain forgets about containers that are no longer in the container list
+func (ps *pullSchedule) retain(keys map[string]bool) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	for key := range ps.nextPulls {
+		if !keys[key] {
+			delete(ps.nextPulls, key)
+		}
+	}
+}
+
+// nextDue returns the time the first container is due to be pulled, or false if nothing is scheduled
+func (ps *pullSchedule) nextDue() (nextDue time.Time, ok bool) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	for _, nextPull := range ps.nextPulls {
+		if !ok || nextPull.Before(nextDue) {
+			nextDue = nextPull
+			ok = true
+		}
+	}
+
+	return
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	pullTriggerSecretHeader = "X-Pull-Trigger-Secret"
+)
+
+// pullTrigger pulls an image on request outside the heating cycles, so a pipeline can warm an image right after pushing
+// it instead of waiting for the next cycle
+type pullTrigger struct {
+	heater *heater
+	// the secret requests have to pass in the X-Pull-Trigger-Secret header, no secret is needed if empty
+	secret string
+}
+
+func newPullTrigger(heater *heater, secret string) *pullTrigger {
+	return &pullTrigger{
+		heater: heater,
+		secret: secret,
+	}
+}
+
+type pullTriggerResponse struct {
+	Image           string  `json:"image"`
+	Platform        string  `json:"platform,omitempty"`
+	Result          string  `json:"result"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	DownloadedBytes int64   `json:"downloadedBytes"`
+}
+
+// pullHandler pulls the image in the image query parameter, for the platform in the optional platform parameter, and
+// responds with the result once the pull finishes
+func (pt *pullTrigger) pullHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if pt.secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(pullTriggerSecretHeader)), []byte(pt.secret)) != 1 {
+		http.Error(w, "Missing or invalid "+pullTriggerSecretHeader+" header", http.StatusUnauthorized)
+		return
+	}
+
+	container := Container{
+		Image:    r.URL.Query().Get("image"),
+		Platform: r.URL.Query().Get("platform"),
+	}
+	if !imageReferenceRegex.MatchString(container.Image) {
+		http.Error(w, "Query parameter image is missing or not a valid image reference", http.StatusBadRequest)
+		return
+	}
+	if container.Platform == "" {
+		container.Platform = pt.heater.defaultPlatform
+	}
+
+	log.Info().Msgf("Pulling docker image '%v' on request", container.Image)
+
+	start := time.Now()
+	downloadedBytes, err := pt.heater.pullImage(r.Context(), container)
+
+	response := pullTriggerResponse{
+		Image:           container.Image,
+		Platform:        container.Platform,
+		Result:          getResultLabel(err),
+		DurationSeconds: time.Since(start).Seconds(),
+		DownloadedBytes: downloadedBytes,
+	}
+	statusCode := http.StatusOK
+	if err != nil {
+		response.Error = err.Error()
+		statusCode = http.StatusBadGateway
+	}
+	// the registry is rate limiting pulls, so tell the caller when to try again instead of pulling right away
+	if rateLimited, ok := err.(rateLimitedError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(rateLimited.until).Seconds()))))
+		statusCode = http.StatusTooManyRequests
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPullHandler(t *testing.T) {
+
+	t.Run("RespondsTooManyRequestsWhileRegistryIsCoolingDown", func(t *testing.T) {
+		// a nil docker runner fails the test if the image is pulled anyway
+		h := newHeater(nil, newHealthChecker(nil), newHeaterStatus(), newJitter(0, rand.NewSource(1)), heaterConfig{
+			maxConcurrentPulls: 1,
+			rateLimitCooldown:  30 * time.Minute,
+		})
+		h.registryCooldowns.start("docker.io", time.Now())
+
+		recorder := httptest.NewRecorder()
+		newPullTrigger(h, "").pullHandler(recorder, httptest.NewRequest(http.MethodPost, "/pull?image=nginx:1.17", nil))
+
+		if recorder.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected status code %v, got %v", http.StatusTooManyRequests, recorder.Code)
+		}
+		if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "1800" {
+			t.Errorf("Expected Retry-After 1800, got %v", retryAfter)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// messages of registries that are rate limiting pulls, like docker hub's toomanyrequests
+var rateLimitedErrors = []string{
+	"toomanyrequests",
+	"too many requests",
+}
+
+// rateLimitedError is a pull that was rate limited by the registry, or skipped because the registry was still rate
+// limiting pulls; err is nil for a skipped pull
+type rateLimitedError struct {
+	registry string
+	until    time.Time
+	err      error
+}
+
+func (e rateLimitedError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("Skipped pull, registry %v is rate limiting pulls until %v", e.registry, e.until.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("Registry %v rate limited the pull, skipping its images until %v: %v", e.registry, e.until.Format(time.RFC3339), e.err)
+}
+
+func isRateLimitedError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, rateLimitedMessage := range rateLimitedErrors {
+		if strings.Contains(message, rateLimitedMessage) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// registryCooldowns tracks the registries that are rate limiting pulls, so their images are skipped until the limit
+// has had time to reset instead of being retried right away
+type registryCooldowns struct {
+	cooldown  time.Duration
+	cooldowns map[string]time.Time
+	mutex     sync.Mutex
+}
+
+func newRegistryCooldowns(cooldown time.Duration) *registryCooldowns {
+	return &registryCooldowns{
+		cooldown:  cooldown,
+		cooldowns: map[string]time.Time{},
+	}
+}
+
+// start skips the images of the registry for the cooldown and returns when it ends; parallel pulls rate limited by the
+// same registry share the cooldown
+func (rc *registryCooldowns) start(registry string, now time.Time) time.Time {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if until, ok := rc.cooldowns[registry]; ok && until.After(now) {
+		return until
+	}
+	if rc.cooldown <= 0 {
+		return now
+	}
+
+	until := now.Add(rc.cooldown)
+	rc.cooldowns[registry] = until
+
+	log.Warn().Msgf("Registry '%v' is rate limiting pulls, skipping its images for %v until %v", registry, rc.cooldown, until.Format(time.RFC3339))
+
+	return until
+}
+
+// get returns when the cooldown of the registry ends, or false if it isn't cooling down
+func (rc *registryCooldowns) get(registry string, now time.Time) (time.Time, bool) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	until, ok := rc.cooldowns[registry]
+	if ok && !until.After(now) {
+		delete(rc.cooldowns, registry)
+		return time.Time{}, false
+	}
+
+	return until, ok
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// refreshTrigger starts a heating cycle on request instead of waiting for the sleep to elapse; only one cycle runs at a
+// time, so a request while a cycle is running or another refresh is pending is turned away
+type refreshTrigger struct {
+	// wakes the heating loop from its sleep
+	wake chan struct{}
+
+	mutex     sync.Mutex
+	running   bool
+	requested chan refreshResponse
+	current   chan refreshResponse
+}
+
+type refreshResponse struct {
+	Attempted       int      `json:"attempted"`
+	Succeeded       int      `json:"succeeded"`
+	Failed          int      `json:"failed"`
+	FailedImages    []string `json:"failedImages,omitempty"`
+	Untrusted       int      `json:"untrusted"`
+	RateLimited     int      `json:"rateLimited"`
+	DownloadedBytes int64    `json:"downloadedBytes"`
+	PulledBytes     int64    `json:"pulledBytes"`
+	DurationSeconds float64  `json:"durationSeconds"`
+	Pruned          bool     `json:"pruned"`
+	Error           string   `json:"error,omitempty"`
+}
+
+func newRefreshTrigger() *refreshTrigger {
+	return &refreshTrigger{
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// started marks a heating cycle as running, taking over a pending refresh request
+func (rt *refreshTrigger) started() {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	rt.running = true
+	rt.current = rt.requested
+	rt.requested = nil
+}
+
+// completed marks the heating cycle as finished and responds to the refresh request that triggered it, if any
+func (rt *refreshTrigger) completed(result cycleResult, duration time.Duration, cycleErr error) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	rt.running = false
+	if rt.current == nil {
+		return
+	}
+
+	response := refreshResponse{
+		Attempted:       result.images,
+		Succeeded:       len(result.pulledImages),
+		Failed:          len(result.failedPulls),
+		Untrusted:       len(result.untrustedImages()),
+		RateLimited:     len(result.rateLimitedImages()),
+		DownloadedBytes: result.downloadedBytes,
+		PulledBytes:     result.pulledBytes,
+		DurationSeconds: duration.Seconds(),
+		Pruned:          result.pruned,
+	}
+	for _, f := range result.failedPulls {
+		response.FailedImages = append(response.FailedImages, f.image)
+	}
+	if cycleErr != nil {
+		response.Error = cycleErr.Error()
+	}
+
+	// buffered, so this doesn't block if the request has gone away in the meantime
+	rt.current <- response
+	rt.current = nil
+}
+
+// refreshHandler wakes the heating loop for an immediate cycle and responds with its summary once it completes
+func (rt *refreshTrigger) refreshHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rt.mutex.Lock()
+	if rt.running || rt.requested != nil {
+		rt.mutex.Unlock()
+		http.Error(w, "A heating cycle is already in progress", http.StatusTooManyRequests)
+		return
+	}
+	done := make(chan refreshResponse, 1)
+	rt.requested = done
+	rt.mutex.Unlock()
+
+	log.Info().Msg("Starting heating cycle on request")
+
+	select {
+	case rt.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case response := <-done:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	case <-r.Context().Done():
+	}
+}
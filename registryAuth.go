@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// dockerConfig is the part of a docker config.json file holding the registry credentials
+type dockerConfig struct {
+	Auths map[string]dockerConfigAuth `json:"auths"`
+}
+
+type dockerConfigAuth struct {
+	Auth     string `json:"auth,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// getAuthConfig returns the credentials to authenticate against the registry with, either set directly or read from a docker config.json file
+func getAuthConfig(credentials RegistryCredentials) (authConfig types.AuthConfig, err error) {
+
+	registry := normalizeRegistry(credentials.Registry)
+
+	if credentials.DockerConfigPath == "" {
+		return types.AuthConfig{
+			Username:      credentials.Username,
+			Password:      credentials.Password,
+			ServerAddress: getServerAddress(registry),
+		}, nil
+	}
+
+	config, err := readDockerConfig(credentials.DockerConfigPath)
+	if err != nil {
+		return authConfig, err
+	}
+
+	for server, auth := range config.Auths {
+		if normalizeRegistry(server) != registry {
+			continue
+		}
+
+		authConfig = types.AuthConfig{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			ServerAddress: getServerAddress(registry),
+		}
+
+		// the auth property holds base64 encoded username:password
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return authConfig, fmt.Errorf("Failed decoding auth for registry %v in docker config %v: %v", registry, credentials.DockerConfigPath, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return authConfig, fmt.Errorf("Invalid auth for registry %v in docker config %v", registry, credentials.DockerConfigPath)
+			}
+			authConfig.Username = parts[0]
+			authConfig.Password = parts[1]
+		}
+
+		return authConfig, nil
+	}
+
+	return authConfig, fmt.Errorf("Docker config %v has no credentials for registry %v", credentials.DockerConfigPath, registry)
+}
+
+func readDockerConfig(path string) (config dockerConfig, err error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("Failed reading docker config %v: %v", path, err)
+	}
+
+	if err = json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("Failed unmarshaling docker config %v: %v", path, err)
+	}
+
+	return config, nil
+}
+
+// hasAuth returns true if the docker config has credentials for the registry
+func (dc dockerConfig) hasAuth(registry string) bool {
+	for server := range dc.Auths {
+		if normalizeRegistry(server) == registry {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getServerAddress returns the address to log in to, which for docker hub is the legacy index address
+func getServerAddress(registry string) string {
+	if registry == "docker.io" {
+		return "https://index.docker.io/v1/"
+	}
+
+	return registry
+}
+
+// encodeAuthConfig returns the credentials in the form the docker api expects them in the X-Registry-Auth header
+func encodeAuthConfig(authConfig types.AuthConfig) (string, error) {
+	data, err := json.Marshal(authConfig)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// parseRegistryMirrorCredentials parses mirror=username:password values into the credentials for each registry mirror
+// host that requires authentication
+func parseRegistryMirrorCredentials(values []string) (map[string]RegistryCredentials, error) {
+	mirrorCredentials := map[string]RegistryCredentials{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Registry mirror credentials are not of the form mirror=username:password")
+		}
+		userPassword := strings.SplitN(parts[1], ":", 2)
+		if len(userPassword) != 2 || userPassword[0] == "" {
+			return nil, fmt.Errorf("Registry mirror credentials for %v are not of the form mirror=username:password", parts[0])
+		}
+		mirror := normalizeRegistry(parts[0])
+		mirrorCredentials[mirror] = RegistryCredentials{
+			Registry: mirror,
+			Username: userPassword[0],
+			Password: userPassword[1],
+		}
+	}
+
+	return mirrorCredentials, nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	registryClientTimeout = 30 * time.Second
+)
+
+var (
+	// matches the parameters of a www-authenticate header, like realm="https://auth.docker.io/token"
+	authenticateParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+	// matches the url of the next page in a link header, like </v2/_catalog?last=b&n=100>; rel="next"
+	nextLinkRegex = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="next"`)
+)
+
+// registryClient talks to the docker registry http api v2 directly, for the things the docker daemon can't do, like
+// listing tags
+type registryClient struct {
+	// registries with a self-signed certificate or plain http, like the docker daemon's --insecure-registry
+	insecureRegistries []string
+
+	httpClient         *http.Client
+	insecureHTTPClient *http.Client
+}
+
+func newRegistryClient(insecureRegistries []string) *registryClient {
+	return &registryClient{
+		insecureRegistries: insecureRegistries,
+		httpClient: &http.Client{
+			Timeout: registryClientTimeout,
+		},
+		insecureHTTPClient: &http.Client{
+			Timeout: registryClientTimeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+}
+
+type tagList struct {
+	Tags []string `json:"tags"`
+}
+
+type catalog struct {
+	Repositories []string `json:"repositories"`
+}
+
+// manifest holds the parts of an image manifest or manifest list needed to find the image config
+type manifest struct {
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+			Variant      string `json:"variant,omitempty"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+type imageConfig struct {
+	Created time.Time `json:"created"`
+}
+
+const (
+	jsonMediaType     = "application/json"
+	manifestMediaType = "application/vnd.docker.distribution.manifest.v2+json, application/vnd.docker.distribution.manifest.list.v2+json, application/vnd.oci.image.manifest.v1+json, application/vnd.oci.image.index.v1+json"
+)
+
+// listRepositories returns all repositories in the registry's catalog, following pagination
+func (rc *registryClient) listRepositories(ctx context.Context, registry string, credentials *RegistryCredentials) (repositories []string, err error) {
+
+	path := "/v2/_catalog"
+	for path != "" {
+		var page catalog
+		path, err = rc.get(ctx, registry, path, jsonMediaType, credentials, &page)
+		if err != nil {
+			return nil, fmt.Errorf("Failed listing repositories of %v: %v", registry, err)
+		}
+		repositories = append(repositories, page.Repositories...)
+	}
+
+	return repositories, nil
+}
+
+// getCreated returns the creation time of the image config a tag points to, using the first image of a multi-platform
+// manifest list
+func (rc *registryClient) getCreated(ctx context.Context, registry, repository, tag string, credentials *RegistryCredentials) (time.Time, error) {
+
+	var m manifest
+	_, err := rc.get(ctx, registry, fmt.Sprintf("/v2/%v/manifests/%v", repository, tag), manifestMediaType, credentials, &m)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Failed fetching manifest of %v/%v:%v: %v", registry, repository, tag, err)
+	}
+
+	if m.Config.Digest == "" && len(m.Manifests) > 0 {
+		digest := m.Manifests[0].Digest
+		m = manifest{}
+		_, err = rc.get(ctx, registry, fmt.Sprintf("/v2/%v/manifests/%v", repository, digest), manifestMediaType, credentials, &m)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Failed fetching manifest of %v/%v@%v: %v", registry, repository, digest, err)
+		}
+	}
+
+	if m.Config.Digest == "" {
+		return time.Time{}, fmt.Errorf("Manifest of %v/%v:%v has no config", registry, repository, tag)
+	}
+
+	var config imageConfig
+	_, err = rc.get(ctx, registry, fmt.Sprintf("/v2/%v/blobs/%v", repository, m.Config.Digest), jsonMediaType, credentials, &config)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Failed fetching config of %v/%v:%v: %v", registry, repository, tag, err)
+	}
+
+	return config.Created, nil
+}
+
+// listTags returns all tags of a repository, following pagination
+func (rc *registryClient) listTags(ctx context.Context, registry, repository string, credentials *RegistryCredentials) (tags []string, err error) {
+
+	path := fmt.Sprintf("/v2/%v/tags/list", repository)
+	for path != "" {
+		var page tagList
+		path, err = rc.get(ctx, registry, path, jsonMediaType, credentials, &page)
+		if err != nil {
+			return nil, fmt.Errorf("Failed listing tags of %v/%v: %v", registry, repository, err)
+		}
+		tags = append(tags, page.Tags...)
+	}
+
+	return tags, nil
+}
+
+// listPlatforms returns the platforms in the manifest list a tag or digest points to, or none if it points to the image
+// of a single platform
+func (rc *registryClient) listPlatforms(ctx context.Context, registry, repository, reference string, credentials *RegistryCredentials) (platforms []string, err error) {
+
+	var m manifest
+	_, err = rc.get(ctx, registry, fmt.Sprintf("/v2/%v/manifests/%v", repository, reference), manifestMediaType, credentials, &m)
+	if err != nil {
+		return nil, fmt.Errorf("Failed fetching manifest of %v/%v:%v: %v", registry, repository, reference, err)
+	}
+
+	for _, mm := range m.Manifests {
+		// skip the attestations buildkit adds to the list, which aren't images that can be pulled
+		if mm.Platform.OS == "" || mm.Platform.OS == "unknown" {
+			continue
+		}
+		platform := mm.Platform.OS + "/" + mm.Platform.Architecture
+		if mm.Platform.Variant != "" {
+			platform += "/" + mm.Platform.Variant
+		}
+		platforms = append(platforms, platform)
+	}
+
+	return platforms, nil
+}
+
+// get requests the path from the registry and unmarshals the json response into target; it returns the path of the
+// next page if the response is paginated
+func (rc *registryClient) get(ctx context.Context, registry, path, accept string, credentials *RegistryCredentials, target interface{}) (nextPath string, err error) {
+
+	resp, err := rc.do(ctx, registry, path, accept, credentials)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Request to %v responded with status code %v", resp.Request.URL, resp.StatusCode)
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(target); err != nil {
+		return "", fmt.Errorf("Failed unmarshaling response of %v: %v", resp.Request.URL, err)
+	}
+
+	if match := nextLinkRegex.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+		nextPath = match[1]
+	}
+
+	return nextPath, nil
+}
+
+// do sends the request and handles the authentication challenge of the registry, using either basic auth or a bearer
+// token fetched from the registry's token service
+func (rc *registryClient) do(ctx context.Context, registry, path, accept string, credentials *RegistryCredentials) (*http.Response, error) {
+
+	resp, err := rc.doWithAuthorization(ctx, registry, path, accept, "")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	username, password, err := getRegistryUsernamePassword(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	switch {
+	case strings.HasPrefix(strings.ToLower(challenge), "basic"):
+		req, err := http.NewRequest(http.MethodGet, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(username, password)
+		return rc.doWithAuthorization(ctx, registry, path, accept, req.Header.Get("Authorization"))
+
+	case strings.HasPrefix(strings.ToLower(challenge), "bearer"):
+		token, err := rc.getBearerToken(ctx, registry, challenge, username, password)
+		if err != nil {
+			return nil, err
+		}
+		return rc.doWithAuthorization(ctx, registry, path, accept, "Bearer "+token)
+	}
+
+	return nil, fmt.Errorf("Registry %v requires unsupported authentication %q", registry, challenge)
+}
+
+func (rc *registryClient) doWithAuthorization(ctx context.Context, registry, path, accept, authorization string) (resp *http.Response, err error) {
+
+	client := rc.httpClient
+	schemes := []string{"https"}
+	if isInsecureRegistry(rc.insecureRegistries, registry) {
+		// like the docker daemon try https without verifying the certificate first and fall back to plain http
+		client = rc.insecureHTTPClient
+		schemes = append(schemes, "http")
+	}
+
+	for _, scheme := range schemes {
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodGet, fmt.Sprintf("%v://%v%v", scheme, getRegistryAPIHost(registry), path), nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Accept", accept)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		resp, err = client.Do(req)
+		if err == nil {
+			return resp, nil
+		}
+	}
+
+	return nil, err
+}
+
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+// getBearerToken fetches a token for the scope in the challenge, anonymously if no credentials are configured
+func (rc *registryClient) getBearerToken(ctx context.Context, registry, challenge, username, password string) (string, error) {
+
+	params := map[string]string{}
+	for _, match := range authenticateParamRegex.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("Registry %v responded with a bearer challenge without realm", registry)
+	}
+
+	query := url.Values{}
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	if params["scope"] != "" {
+		query.Set("scope", params["scope"])
+	}
+
+	req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	client := rc.httpClient
+	if isInsecureRegistry(rc.insecureRegistries, registry) {
+		client = rc.insecureHTTPClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Failed fetching token for registry %v: %v", registry, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Failed fetching token for registry %v: status code %v", registry, resp.StatusCode)
+	}
+
+	var token tokenResponse
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("Failed unmarshaling token for registry %v: %v", registry, err)
+	}
+
+	if token.Token != "" {
+		return token.Token, nil
+	}
+
+	return token.AccessToken, nil
+}
+
+// getRegistryUsernamePassword returns the configured credentials, or empty ones to authenticate anonymously
+func getRegistryUsernamePassword(credentials *RegistryCredentials) (username, password string, err error) {
+	if credentials == nil {
+		return "", "", nil
+	}
+
+	authConfig, err := getAuthConfig(*credentials)
+	if err != nil {
+		return "", "", err
+	}
+
+	return authConfig.Username, authConfig.Password, nil
+}
+
+// getRegistryAPIHost returns the host serving the registry api, which for docker hub differs from its name
+func getRegistryAPIHost(registry string) string {
+	if registry == "docker.io" {
+		return "registry-1.docker.io"
+	}
+
+	return registry
+}
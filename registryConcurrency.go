@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// parseRegistryConcurrency parses registry=limit values into the maximum number of parallel pulls per registry
+func parseRegistryConcurrency(values []string) (map[string]int, error) {
+	registryConcurrency := map[string]int{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Registry concurrency %v is not of the form registry=limit", value)
+		}
+		limit, err := strconv.Atoi(parts[1])
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("Registry concurrency %v doesn't have a positive limit", value)
+		}
+		registryConcurrency[normalizeRegistry(parts[0])] = limit
+	}
+
+	return registryConcurrency, nil
+}
+
+// getRegistryConcurrency returns the maximum number of parallel pulls per registry set with flags, overridden by the
+// limits in the container list
+func (h *heater) getRegistryConcurrency(containerList ContainerList) map[string]int {
+	registryConcurrency := map[string]int{}
+	for registry, limit := range h.registryConcurrency {
+		registryConcurrency[registry] = limit
+	}
+	for registry, limit := range containerList.RegistryConcurrency {
+		registryConcurrency[normalizeRegistry(registry)] = limit
+	}
+
+	return registryConcurrency
+}
+
+// pullSlots limits the parallel pulls overall and from registries with a concurrency limit; it's shared by the heating
+// cycles and the pulls on request, so together they stay within the limits
+type pullSlots struct {
+	limit          int
+	registryLimits map[string]int
+
+	pulls         int
+	registryPulls map[string]int
+	// closed and replaced whenever a slot may have become available, to wake up the waiting pulls
+	changed chan struct{}
+	mutex   sync.Mutex
+}
+
+func newPullSlots(limit int, registryLimits map[string]int) *pullSlots {
+	return &pullSlots{
+		limit:          limit,
+		registryLimits: registryLimits,
+		registryPulls:  map[string]int{},
+		changed:        make(chan struct{}),
+	}
+}
+
+// setLimits changes the limits for the next pulls; pulls already running keep their slots
+func (ps *pullSlots) setLimits(limit int, registryLimits map[string]int) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.limit = limit
+	ps.registryLimits = registryLimits
+	ps.notify()
+}
+
+// acquire waits for a slot to pull from the registry and returns a func to release it, or false if the context is done
+// first; a pull only takes an overall slot once its registry has a slot as well, so pulls from a limited registry don't
+// take up the overall slots while they wait
+func (ps *pullSlots) acquire(ctx context.Context, registry string) (release func(), ok bool) {
+	for {
+		ps.mutex.Lock()
+		registryLimit, limited := ps.registryLimits[registry]
+		if ps.pulls < ps.limit && (!limited || ps.registryPulls[registry] < registryLimit) {
+			ps.pulls++
+			ps.registryPulls[registry]++
+			ps.mutex.Unlock()
+			return func() { ps.release(registry) }, true
+		}
+		changed := ps.changed
+		ps.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+func (ps *pullSlots) release(registry string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.pulls--
+	ps.registryPulls[registry]--
+	if ps.registryPulls[registry] == 0 {
+		delete(ps.registryPulls, registry)
+	}
+	ps.notify()
+}
+
+func (ps *pullSlots) notify() {
+	close(ps.changed)
+	ps.changed = make(chan struct{})
+}
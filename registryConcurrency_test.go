@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPullSlots(t *testing.T) {
+
+	t.Run("LimitsOverallAndPerRegistryPulls", func(t *testing.T) {
+		ps := newPullSlots(2, map[string]int{"docker.io": 1})
+
+		releaseDockerHub, ok := ps.acquire(context.Background(), "docker.io")
+		if !ok {
+			t.Fatalf("Expected a slot for docker.io")
+		}
+		if acquired(ps, "docker.io") {
+			t.Errorf("Expected no second slot for docker.io")
+		}
+		releaseGcr, ok := ps.acquire(context.Background(), "gcr.io")
+		if !ok {
+			t.Fatalf("Expected a slot for gcr.io")
+		}
+		if acquired(ps, "quay.io") {
+			t.Errorf("Expected no third slot")
+		}
+
+		releaseDockerHub()
+		releaseGcr()
+		if !acquired(ps, "docker.io") {
+			t.Errorf("Expected a slot for docker.io once released")
+		}
+	})
+
+	t.Run("WakesWaitingPullOnRelease", func(t *testing.T) {
+		ps := newPullSlots(1, nil)
+		release, _ := ps.acquire(context.Background(), "docker.io")
+
+		acquiredSlot := make(chan bool)
+		go func() {
+			_, ok := ps.acquire(context.Background(), "gcr.io")
+			acquiredSlot <- ok
+		}()
+		release()
+
+		select {
+		case ok := <-acquiredSlot:
+			if !ok {
+				t.Errorf("Expected the waiting pull to get the released slot")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the waiting pull to get the released slot")
+		}
+	})
+
+	t.Run("WakesWaitingPullOnRaisedLimit", func(t *testing.T) {
+		ps := newPullSlots(1, nil)
+		ps.acquire(context.Background(), "docker.io")
+
+		acquiredSlot := make(chan bool)
+		go func() {
+			_, ok := ps.acquire(context.Background(), "docker.io")
+			acquiredSlot <- ok
+		}()
+		ps.setLimits(2, nil)
+
+		select {
+		case ok := <-acquiredSlot:
+			if !ok {
+				t.Errorf("Expected the waiting pull to get a slot")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the waiting pull to get a slot")
+		}
+	})
+}
+
+// acquired returns whether a slot is available right away, and releases it again
+func acquired(ps *pullSlots, registry string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	release, ok := ps.acquire(ctx, registry)
+	if ok {
+		release()
+	}
+	return ok
+}
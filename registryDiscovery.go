@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// discoverContainers lists the repositories in the discovery registry's catalog and returns the most recently created
+// tags of each repository matching the filter
+func (h *heater) discoverContainers(ctx context.Context, containerList ContainerList) (containers []Container, failures []pullFailure) {
+
+	registry := normalizeRegistry(h.discoveryRegistry)
+	credentials := h.getCredentialsByRegistry(containerList, registry)
+
+	repositories, err := h.registryClient.listRepositories(ctx, registry, credentials)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed discovering repositories in registry %v", registry)
+		return nil, []pullFailure{{image: registry, err: err}}
+	}
+
+	// the filter is validated at startup
+	repoFilter := regexp.MustCompile(h.discoveryRepoFilter)
+
+	matchingRepositories := 0
+	for _, repository := range repositories {
+		if !repoFilter.MatchString(repository) {
+			continue
+		}
+		matchingRepositories++
+
+		image := registry + "/" + repository
+		tags, err := h.getMostRecentTags(ctx, registry, repository, credentials)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed discovering tags of repository '%v'", image)
+			failures = append(failures, pullFailure{image: image, err: err})
+			continue
+		}
+
+		for _, tag := range tags {
+			containers = append(containers, Container{Image: image + ":" + tag})
+		}
+	}
+
+	log.Info().Msgf("Discovered %v images in %v of %v repositories in registry %v", len(containers), matchingRepositories, len(repositories), registry)
+
+	return
+}
+
+// getMostRecentTags returns the tags of the repository with the most recently created images, leaving out the ones older
+// than the maximum age
+func (h *heater) getMostRecentTags(ctx context.Context, registry, repository string, credentials *RegistryCredentials) ([]string, error) {
+
+	tags, err := h.registryClient.listTags(ctx, registry, repository, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	// the tag list isn't ordered by date, so the creation date has to be read from the image config of each tag
+	created := map[string]time.Time{}
+	for _, tag := range tags {
+		created[tag], err = h.registryClient.getCreated(ctx, registry, repository, tag, credentials)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed reading creation date of '%v/%v:%v', skipping it", registry, repository, tag)
+			delete(created, tag)
+		}
+	}
+
+	// don't heat ancient tags, even if the repository has no recent ones
+	if h.discoveryMaxImageAgeDays > 0 {
+		minCreated := time.Now().AddDate(0, 0, -h.discoveryMaxImageAgeDays)
+		for tag, tagCreated := range created {
+			if tagCreated.Before(minCreated) {
+				log.Debug().Msgf("Skipping '%v/%v:%v', it was created more than %v days ago", registry, repository, tag, h.discoveryMaxImageAgeDays)
+				delete(created, tag)
+			}
+		}
+	}
+
+	recentTags := make([]string, 0, len(created))
+	for tag := range created {
+		recentTags = append(recentTags, tag)
+	}
+	sort.Slice(recentTags, func(i, j int) bool {
+		return created[recentTags[i]].After(created[recentTags[j]])
+	})
+
+	if len(recentTags) > h.discoveryTagsPerRepo {
+		recentTags = recentTags[:h.discoveryTagsPerRepo]
+	}
+
+	return recentTags, nil
+}
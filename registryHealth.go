@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// bounds a single request to the registry health endpoint, so a hanging endpoint doesn't block startup
+	registryHealthAttemptTimeout = 10 * time.Second
+)
+
+type registryHealthConfig struct {
+	endpoints []string
+	// a timeout of 0 waits indefinitely
+	timeout time.Duration
+	// headers in the form 'Name: value', for example to pass a bearer token
+	headers               []string
+	caCertPath            string
+	insecureSkipTLSVerify bool
+}
+
+type registryHealthChecker struct {
+	registryHealthConfig
+	client  *http.Client
+	headers http.Header
+	jitter  *jitter
+}
+
+func newRegistryHealthChecker(jitter *jitter, config registryHealthConfig) (*registryHealthChecker, error) {
+
+	client, err := newRegistryHealthClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := parseHeaders(config.headers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &registryHealthChecker{
+		registryHealthConfig: config,
+		client:               client,
+		headers:              headers,
+		jitter:               jitter,
+	}, nil
+}
+
+// wait polls the registry health endpoints until all of them respond with 200 OK
+func (rh *registryHealthChecker) wait(ctx context.Context) error {
+
+	endpoints := rh.endpoints
+	timeout := rh.timeout
+
+	start := time.Now()
+	notReady := endpoints
+	for {
+		log.Info().Strs("endpoints", notReady).Msgf("Waiting for %v of %v registry health endpoints to be ready", len(notReady), len(endpoints))
+
+		// only poll the endpoints that haven't been ready before
+		stillNotReady := []string{}
+		for _, endpoint := range notReady {
+			err := rh.check(ctx, endpoint)
+			if err != nil {
+				log.Warn().Err(err).Msgf("Registry health endpoint at %v is not ready", endpoint)
+				stillNotReady = append(stillNotReady, endpoint)
+			}
+		}
+		notReady = stillNotReady
+
+		if len(notReady) == 0 {
+			log.Info().Msg("Registries are ready")
+			return nil
+		}
+
+		if timeout > 0 && time.Since(start) >= timeout {
+			return fmt.Errorf("Registry health endpoints %v did not become ready within %v", strings.Join(notReady, ", "), timeout)
+		}
+		sleepTime := rh.jitter.apply(10)
+		log.Info().Msgf("Sleeping for %v seconds...", sleepTime)
+		select {
+		case <-time.After(time.Duration(sleepTime) * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// newRegistryHealthClient creates the http client for the health probe only, the docker daemon doesn't use these tls settings
+func newRegistryHealthClient(config registryHealthConfig) (*http.Client, error) {
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.insecureSkipTLSVerify,
+	}
+
+	if config.caCertPath != "" {
+		caCert, err := ioutil.ReadFile(config.caCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading registry health ca certificate %v: %v", config.caCertPath, err)
+		}
+
+		// trust the custom ca in addition to the system ones
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("Failed parsing registry health ca certificate %v: no pem certificates found", config.caCertPath)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	return &http.Client{
+		Timeout: registryHealthAttemptTimeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}, nil
+}
+
+// parseHeaders parses headers in the form 'Name: value'
+func parseHeaders(values []string) (http.Header, error) {
+	headers := http.Header{}
+	for i, value := range values {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Header %v is not in the form 'Name: value'", i+1)
+		}
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return headers, nil
+}
+
+func (rh *registryHealthChecker) check(ctx context.Context, endpoint string) error {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range rh.headers {
+		req.Header[name] = values
+	}
+
+	resp, err := rh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Registry health endpoint responded with status code %v", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// registryLogins remembers the credentials each registry was logged in with, so the runners only log in once for each
+// set of credentials
+type registryLogins struct {
+	credentials map[string]RegistryCredentials
+	mutex       sync.Mutex
+}
+
+func newRegistryLogins() *registryLogins {
+	return &registryLogins{
+		credentials: map[string]RegistryCredentials{},
+	}
+}
+
+// login runs the login for the normalized registry of the credentials unless it's already logged in with them; it holds
+// the lock during the login, so parallel pulls from the same registry don't all log in
+func (rl *registryLogins) login(credentials RegistryCredentials, login func(registry string) error) error {
+
+	registry := normalizeRegistry(credentials.Registry)
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if loggedInCredentials, ok := rl.credentials[registry]; ok && loggedInCredentials == credentials {
+		return nil
+	}
+
+	log.Info().Msgf("Logging in to registry '%v' as user '%v'", registry, credentials.Username)
+
+	err := login(registry)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed logging in to registry '%v'", registry)
+		return err
+	}
+
+	rl.credentials[registry] = credentials
+
+	return nil
+}
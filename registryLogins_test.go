@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRegistryLoginsLogin(t *testing.T) {
+
+	t.Run("LogsInOnceForEachSetOfCredentials", func(t *testing.T) {
+		rl := newRegistryLogins()
+		logins := []string{}
+		login := func(registry string) error {
+			logins = append(logins, registry)
+			return nil
+		}
+
+		rl.login(RegistryCredentials{Registry: "https://index.docker.io/v1/", Username: "user", Password: "secret"}, login)
+		rl.login(RegistryCredentials{Registry: "https://index.docker.io/v1/", Username: "user", Password: "secret"}, login)
+		rl.login(RegistryCredentials{Registry: "https://index.docker.io/v1/", Username: "user", Password: "rotated"}, login)
+
+		expected := []string{"docker.io", "docker.io"}
+		if !reflect.DeepEqual(logins, expected) {
+			t.Errorf("Expected logins %v, got %v", expected, logins)
+		}
+	})
+
+	t.Run("LogsInAgainAfterFailedLogin", func(t *testing.T) {
+		rl := newRegistryLogins()
+		credentials := RegistryCredentials{Registry: "gcr.io", Username: "user", Password: "secret"}
+		attempts := 0
+
+		err := rl.login(credentials, func(registry string) error {
+			attempts++
+			return fmt.Errorf("unauthorized")
+		})
+		if err == nil {
+			t.Fatalf("Expected the error of the login")
+		}
+		err = rl.login(credentials, func(registry string) error {
+			attempts++
+			return nil
+		})
+
+		if err != nil || attempts != 2 {
+			t.Errorf("Expected a second login without error, got %v attempts and error %v", attempts, err)
+		}
+	})
+}
+
+func TestIsInsecureRegistry(t *testing.T) {
+
+	insecureRegistries := []string{"http://registry.local:5000", "mirror.local"}
+
+	for registry, expected := range map[string]bool{
+		"registry.local:5000": true,
+		"mirror.local":        true,
+		"registry.local":      false,
+		"docker.io":           false,
+	} {
+		if isInsecure := isInsecureRegistry(insecureRegistries, registry); isInsecure != expected {
+			t.Errorf("Expected %v for %v, got %v", expected, registry, isInsecure)
+		}
+	}
+}
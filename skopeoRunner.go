@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	containersStorageDestination = "containers-storage"
+	ociLayoutDestinationPrefix   = "oci:"
+)
+
+// skopeoRunnerConfig holds the settings for copying images with skopeo
+type skopeoRunnerConfig struct {
+	// either containers-storage or oci:<directory> for an oci image layout
+	destination        string
+	insecureRegistries []string
+	pullMaxRetries     int
+	// retry pulls the registry rate limited, when the heater doesn't skip the registry for a cooldown instead
+	retryRateLimitedPulls bool
+	pullTimeoutSeconds    int
+	quietPulls            bool
+	pullPriority          pullPriority
+	// log the skopeo commands equivalent to the pulls and removals instead of running them
+	dryRun bool
+}
+
+// skopeoRunner implements DockerRunner by copying images into a local store with skopeo, for environments where no
+// docker daemon can run
+type skopeoRunner struct {
+	skopeoRunnerConfig
+
+	jitter *jitter
+
+	// creates the skopeo processes, exec.CommandContext unless replaced to avoid running skopeo
+	execCommand func(ctx context.Context, name string, arg ...string) *exec.Cmd
+
+	registryLogins *registryLogins
+}
+
+// newSkopeoRunner returns a DockerRunner using skopeo
+func newSkopeoRunner(jitter *jitter, config skopeoRunnerConfig) (DockerRunner, error) {
+
+	if config.destination != containersStorageDestination && (!strings.HasPrefix(config.destination, ociLayoutDestinationPrefix) || config.destination == ociLayoutDestinationPrefix) {
+		return nil, fmt.Errorf("Skopeo destination %v is not supported, use %v or %v<directory>", config.destination, containersStorageDestination, ociLayoutDestinationPrefix)
+	}
+
+	return &skopeoRunner{
+		skopeoRunnerConfig: config,
+
+		jitter:      jitter,
+		execCommand: exec.CommandContext,
+
+		registryLogins: newRegistryLogins(),
+	}, nil
+}
+
+// startDockerDaemon does nothing, since skopeo copies images without a daemon
+func (sr *skopeoRunner) startDockerDaemon() error {
+	log.Info().Msgf("Copying images to %v with skopeo instead of running a docker daemon", sr.destination)
+	return nil
+}
+
+// waitForDockerDaemon checks skopeo is installed, so a missing binary fails at startup instead of at every pull
+func (sr *skopeoRunner) waitForDockerDaemon(ctx context.Context) error {
+	if _, err := exec.LookPath("skopeo"); err != nil {
+		return fmt.Errorf("Failed finding skopeo, which isn't part of the published image: %v", err)
+	}
+	return nil
+}
+
+func (sr *skopeoRunner) superviseDockerDaemon(ctx context.Context) {
+}
+
+func (sr *skopeoRunner) isDockerDaemonReady(ctx context.Context) bool {
+	_, err := exec.LookPath("skopeo")
+	return err == nil
+}
+
+func (sr *skopeoRunner) runDockerLogin(ctx context.Context, credentials RegistryCredentials) (err error) {
+
+	// there's nothing to log in with, a docker config file is passed to skopeo copy directly
+	if credentials.Username == "" || credentials.DockerConfigPath != "" {
+		return
+	}
+
+	return sr.registryLogins.login(credentials, func(registry string) error {
+		// pass the password on stdin, so it doesn't show up in the process list
+		args := []string{"login", "--username", credentials.Username, "--password-stdin"}
+		if isInsecureRegistry(sr.insecureRegistries, registry) {
+			args = append(args, "--tls-verify=false")
+		}
+		args = append(args, registry)
+
+		cmd := sr.execCommand(ctx, "skopeo", args...)
+		cmd.Stdin = strings.NewReader(credentials.Password)
+		_, err := runCommand(cmd)
+		return err
+	})
+}
+
+func (sr *skopeoRunner) runDockerPull(ctx context.Context, container Container, credentials *RegistryCredentials) (downloadedBytes int64, err error) {
+
+	args := []string{"copy"}
+
+	if container.Platform != "" {
+		// platforms are in the form os/arch[/variant]
+		platform := strings.SplitN(container.Platform, "/", 3)
+		args = append(args, fmt.Sprintf("--override-os=%v", platform[0]))
+		if len(platform) > 1 {
+			args = append(args, fmt.Sprintf("--override-arch=%v", platform[1]))
+		}
+		if len(platform) > 2 {
+			args = append(args, fmt.Sprintf("--override-variant=%v", platform[2]))
+		}
+	}
+
+	if isInsecureRegistry(sr.insecureRegistries, getImageRegistry(container.Image)) {
+		args = append(args, "--src-tls-verify=false")
+	}
+
+	if credentials != nil && credentials.DockerConfigPath != "" {
+		args = append(args, fmt.Sprintf("--src-authfile=%v", credentials.DockerConfigPath))
+	}
+
+	args = append(args, "docker://"+container.Image, sr.getDestinationReference(container.Image))
+
+	if sr.dryRun {
+		log.Info().Msgf("Dry run: skopeo %v", strings.Join(args, " "))
+		return
+	}
+
+	if credentials != nil {
+		err = sr.runDockerLogin(ctx, *credentials)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed pulling container image '%v'", container.Image)
+			return
+		}
+	}
+
+	return pullWithRetries(ctx, sr.jitter, container, sr.pullMaxRetries, sr.retryRateLimitedPulls, sr.quietPulls, func(ctx context.Context) (int64, error) {
+		// cancel the copy once it exceeds the timeout, so a hanging copy doesn't block the heating cycle
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(sr.pullTimeoutSeconds)*time.Second)
+		defer cancel()
+
+		// skopeo doesn't report the number of downloaded bytes
+		name, priorityArgs := sr.pullPriority.wrap("skopeo", args...)
+		_, err := runCommand(sr.execCommand(ctx, name, priorityArgs...))
+		return 0, err
+	})
+}
+
+func (sr *skopeoRunner) runDockerLoad(ctx context.Context, containerImage, tarballPath string) (err error) {
+
+	args := []string{"copy", "docker-archive:" + tarballPath, sr.getDestinationReference(containerImage)}
+
+	if sr.dryRun {
+		log.Info().Msgf("Dry run: skopeo %v", strings.Join(args, " "))
+		return
+	}
+
+	log.Info().Msgf("Loading docker image '%v' from %v", containerImage, tarballPath)
+
+	_, err = runCommand(sr.execCommand(ctx, "skopeo", args...))
+
+	return
+}
+
+func (sr *skopeoRunner) runDockerRemoveImage(ctx context.Context, containerImage string) (err error) {
+
+	destinationReference := sr.getDestinationReference(containerImage)
+
+	if sr.dryRun {
+		log.Info().Msgf("Dry run: skopeo delete %v", destinationReference)
+		return
+	}
+
+	log.Info().Msgf("Removing docker image '%v'", containerImage)
+
+	_, err = runCommand(sr.execCommand(ctx, "skopeo", "delete", destinationReference))
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed removing container image '%v'", containerImage)
+	}
+
+	return
+}
+
+// skopeoInspect is the part of the skopeo inspect output needed for the digest and size of an image
+type skopeoInspect struct {
+	Digest     string `json:"Digest"`
+	LayersData []struct {
+		Size int64 `json:"Size"`
+	} `json:"LayersData"`
+}
+
+// getImageDigests returns the digest of the copied image; for an oci layout destination this differs from the digest
+// in the registry if skopeo converted the manifest
+func (sr *skopeoRunner) getImageDigests(ctx context.Context, containerImage string) ([]string, error) {
+
+	inspect, err := sr.inspect(ctx, containerImage)
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{inspect.Digest}, nil
+}
+
+func (sr *skopeoRunner) getImageSize(ctx context.Context, containerImage string) (sizeBytes int64, err error) {
+
+	inspect, err := sr.inspect(ctx, containerImage)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, layer := range inspect.LayersData {
+		sizeBytes += layer.Size
+	}
+
+	return sizeBytes, nil
+}
+
+// listImages isn't supported, skopeo can't list the images in a local store
+func (sr *skopeoRunner) listImages(ctx context.Context) ([]localImage, error) {
+	return nil, fmt.Errorf("The skopeo runner can't list images")
+}
+
+// runDockerSystemPrune does nothing, since skopeo can't remove unused images from a local store; use
+// --max-cache-bytes to remove images instead
+func (sr *skopeoRunner) runDockerSystemPrune(ctx context.Context, keepImages []string) error {
+	log.Debug().Msg("Skipping pruning, the skopeo runner doesn't support it")
+	return nil
+}
+
+func (sr *skopeoRunner) runDockerImagePrune(ctx context.Context) error {
+	log.Debug().Msg("Skipping pruning dangling images, the skopeo runner doesn't support it")
+	return nil
+}
+
+func (sr *skopeoRunner) inspect(ctx context.Context, containerImage string) (inspect skopeoInspect, err error) {
+
+	output, err := runCommand(sr.execCommand(ctx, "skopeo", "inspect", sr.getDestinationReference(containerImage)))
+	if err != nil {
+		return inspect, err
+	}
+
+	if err = json.Unmarshal(output, &inspect); err != nil {
+		return inspect, fmt.Errorf("Failed unmarshaling skopeo inspect output for image %v: %v", containerImage, err)
+	}
+
+	return inspect, nil
+}
+
+// getDestinationReference returns the reference of the image in the local store; in an oci layout images are stored
+// under their fully qualified name, so different images don't overwrite each other
+func (sr *skopeoRunner) getDestinationReference(containerImage string) string {
+	if sr.destination == containersStorageDestination {
+		return fmt.Sprintf("%v:%v", containersStorageDestination, containerImage)
+	}
+
+	return fmt.Sprintf("%v:%v", sr.destination, normalizeImage(containerImage))
+}
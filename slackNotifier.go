@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	slackTimeout = 10 * time.Second
+)
+
+// slackNotifier alerts in slack when an image fails to pull in a number of consecutive heating cycles
+type slackNotifier struct {
+	webhookURL       string
+	failureThreshold int
+	client           *http.Client
+
+	// the number of consecutive cycles each image failed to pull in, only used from the heating loop
+	consecutiveFailures map[string]int
+}
+
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+func newSlackNotifier(webhookURL string, failureThreshold int) *slackNotifier {
+	return &slackNotifier{
+		webhookURL:       webhookURL,
+		failureThreshold: failureThreshold,
+		client: &http.Client{
+			Timeout: slackTimeout,
+		},
+		consecutiveFailures: map[string]int{},
+	}
+}
+
+// observe updates the consecutive failures of the images pulled in the cycle and sends a message for each image
+// reaching the threshold; images that weren't due keep their count
+func (sn *slackNotifier) observe(result cycleResult) {
+
+	if sn.webhookURL == "" {
+		return
+	}
+
+	for _, image := range result.pulledImages {
+		delete(sn.consecutiveFailures, image)
+	}
+
+	for _, f := range result.failedPulls {
+		sn.consecutiveFailures[f.image]++
+
+		// only alert once when crossing the threshold, not on every cycle after
+		if sn.consecutiveFailures[f.image] != sn.failureThreshold {
+			continue
+		}
+
+		hostname, _ := os.Hostname()
+		text := fmt.Sprintf("Image `%v` failed to pull in %v consecutive heating cycles on %v: %v", f.image, sn.failureThreshold, hostname, f.err)
+		if err := sn.send(slackMessage{Text: text}); err != nil {
+			log.Warn().Err(err).Msgf("Failed notifying slack about image '%v'", f.image)
+		}
+	}
+}
+
+func (sn *slackNotifier) send(message slackMessage) error {
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	resp, err := sn.client.Post(sn.webhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Slack responded with status code %v", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	statsdPrefix = "estafette_docker_cache_heater."
+)
+
+// statsd sends the metrics to a statsd endpoint as well if --statsd-address is set, nil otherwise
+var statsd *statsdClient
+
+// statsdClient sends metrics over udp in the dogstatsd format, which plain statsd servers accept as well when they
+// ignore the tags
+type statsdClient struct {
+	conn net.Conn
+}
+
+func newStatsdClient(address string) (*statsdClient, error) {
+
+	// udp doesn't connect, so this only fails on an invalid address
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed setting up statsd client for %v: %v", address, err)
+	}
+
+	return &statsdClient{
+		conn: conn,
+	}, nil
+}
+
+func (sc *statsdClient) timing(name string, duration time.Duration, tags ...string) {
+	sc.send(name, fmt.Sprintf("%d|ms", duration.Nanoseconds()/int64(time.Millisecond)), tags)
+}
+
+func (sc *statsdClient) count(name string, value int64, tags ...string) {
+	sc.send(name, fmt.Sprintf("%d|c", value), tags)
+}
+
+func (sc *statsdClient) increment(name string, tags ...string) {
+	sc.count(name, 1, tags...)
+}
+
+// send writes a single metric; failures are only logged, metrics should never get in the way of heating the cache
+func (sc *statsdClient) send(name, value string, tags []string) {
+	if sc == nil {
+		return
+	}
+
+	metric := statsdPrefix + name + ":" + value
+	if len(tags) > 0 {
+		metric += "|#" + strings.Join(tags, ",")
+	}
+
+	if _, err := sc.conn.Write([]byte(metric)); err != nil {
+		log.Debug().Err(err).Msgf("Failed sending metric %v to statsd", name)
+	}
+}
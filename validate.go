@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// validateContainerListFiles checks the container list files at the path the same way the heater reads them, without
+// expanding environment variables, which usually aren't set where the files are validated; it writes the problems and a
+// summary to w and returns whether all files are valid
+func validateContainerListFiles(path, valuesFile string, w io.Writer) bool {
+
+	if path == "" || isURL(path) {
+		fmt.Fprintf(w, "Container list %q is not a file, directory or glob pattern to validate\n", path)
+		return false
+	}
+
+	files, err := getContainerListFiles(path)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return false
+	}
+
+	images := 0
+	problems := 0
+	for _, file := range files {
+		fileImages, fileProblems := validateContainerListFile(file, valuesFile)
+		images += fileImages
+		problems += len(fileProblems)
+		for _, problem := range fileProblems {
+			fmt.Fprintf(w, "%v: %v\n", file, problem)
+		}
+	}
+
+	fmt.Fprintf(w, "Found %v images in %v container list files with %v problems\n", images, len(files), problems)
+
+	return problems == 0
+}
+
+// validateContainerListFile returns the number of valid images in the file and its problems
+func validateContainerListFile(file, valuesFile string) (images int, problems []string) {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, []string{err.Error()}
+	}
+
+	data, err = renderContainerList(file, data, valuesFile)
+	if err != nil {
+		return 0, []string{err.Error()}
+	}
+
+	// unmarshal strict like the heater, so non-defined properties or incorrect nesting fail
+	var containerList ContainerList
+	if err = yaml.UnmarshalStrict(data, &containerList); err != nil {
+		return 0, []string{err.Error()}
+	}
+
+	if err = containerList.validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	// the heater skips invalid images, but here they're a problem to fix
+	for _, image := range containerList.removeInvalidImages() {
+		problems = append(problems, fmt.Sprintf("Image '%v' is not a valid image reference", image))
+	}
+
+	return len(containerList.Containers), problems
+}